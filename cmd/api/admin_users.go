@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// The listUsersHandler() lists users for admins, optionally only those who are (or
+// aren't) activated, whose email address contains the given text, or who have a role.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email     string
+		Activated *bool
+		Role      string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Email = app.readString(qs, "email", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.Role = app.readString(qs, "role", "")
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Email, input.Activated, input.Role, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The banUserHandler() bans a user and signs them out everywhere. Banned users can't
+// log in or use the API, including through their API keys and OAuth clients, until
+// the ban is lifted. Revoking stateless tokens only reaches this instance of the API,
+// so the others rely on the token backend looking up whether the user is banned.
+func (app *application) banUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == app.contextGetUser(r).ID {
+		app.errorResponse(w, r, http.StatusConflict, "you can't ban yourself")
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Reason != "", "reason", "must be provided")
+	v.Check(len(input.Reason) <= 1000, "reason", "must not be more than 1000 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Ban(user, input.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) unbanUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Users.Unban(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deactivateUserHandler() deactivates a user and signs them out everywhere. They
+// can't activate their account again, as pending activation tokens are deleted and no
+// new ones are accepted, until an admin forces re-activation.
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminDeactivateUser(w, r, app.models.Users.Deactivate)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The reactivateUserHandler() forces a user to activate their account again, for
+// example when their email address may no longer be theirs, or to lift a deactivation.
+// It deactivates them until they do and emails them a new activation token.
+func (app *application) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminDeactivateUser(w, r, app.models.Users.RequireActivation)
+	if !ok {
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.sendActivationEmail(user, token)
+
+	env := envelope{"message": "an email will be sent to the user containing activation instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminDeactivateUser() helper deactivates the user in the id URL parameter with
+// the given model method, and revokes their sessions and activation tokens. If it
+// can't, it sends the response itself and returns false.
+func (app *application) adminDeactivateUser(w http.ResponseWriter, r *http.Request, deactivate func(*data.User) error) (*data.User, bool) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return nil, false
+	}
+	if user.ID == app.contextGetUser(r).ID {
+		app.errorResponse(w, r, http.StatusConflict, "you can't deactivate yourself")
+		return nil, false
+	}
+
+	err := deactivate(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+	err = app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+	return user, true
+}
+
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The updateUserPermissionsHandler() replaces the permissions granted to a user
+// individually. Permissions they have through their roles are managed with the role
+// endpoints instead.
+func (app *application) updateUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	all, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range input.Permissions {
+		v.Check(all.Include(code), "permissions", "must only contain known permissions")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Permissions.SetForUser(user.ID, input.Permissions...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The writeUserPermissions() helper responds with the permissions granted to a user
+// individually, along with all of the permissions they have including those of their
+// roles.
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	direct, err := app.models.Permissions.GetDirectForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	effective, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if effective == nil {
+		effective = data.Permissions{}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": direct, "effective_permissions": effective}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
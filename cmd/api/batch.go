@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// The outcome of each operation in a batch, as reported in batchResult.Status.
+const (
+	batchCreated    = "created"
+	batchUpdated    = "updated"
+	batchDeleted    = "deleted"
+	batchFailed     = "failed"
+	batchRolledBack = "rolled_back"
+	batchSkipped    = "skipped"
+)
+
+type batchResult struct {
+	Index  int               `json:"index"`
+	Op     string            `json:"op"`
+	Status string            `json:"status"`
+	ID     int64             `json:"id,omitempty"`
+	Book   *data.Book        `json:"book,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// batchError is returned from inside the transaction when an operation fails, and
+// carries the HTTP status code to send along with the per-operation errors.
+type batchError struct {
+	index  int
+	status int
+	errors map[string]string
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("batch operation %d failed", e.index)
+}
+
+// The batchBooksHandler() applies a list of create, update and delete operations in a
+// single transaction. Every operation goes through ValidateBook() and the version
+// check, and if any of them fails the whole batch is rolled back. The response lists
+// the outcome of each operation.
+func (app *application) batchBooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Operations []struct {
+			Op      string     `json:"op"`
+			ID      int64      `json:"id"`
+			Version int32      `json:"version"`
+			Book    *bookInput `json:"book"`
+		} `json:"operations"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Operations) >= 1, "operations", "must contain at least 1 operation")
+	v.Check(len(input.Operations) <= 100, "operations", "must not contain more than 100 operations")
+	for i, op := range input.Operations {
+		key := fmt.Sprintf("operations[%d]", i)
+		v.Check(validator.PermittedValue(op.Op, "create", "update", "delete"), key+".op", "must be one of create, update or delete")
+		switch op.Op {
+		case "create":
+			v.Check(op.Book != nil, key+".book", "must be provided")
+			v.Check(op.ID == 0, key+".id", "must not be provided")
+		case "update":
+			v.Check(op.Book != nil, key+".book", "must be provided")
+			fallthrough
+		case "delete":
+			v.Check(op.ID > 0, key+".id", "must be provided")
+			v.Check(op.Version > 0, key+".version", "must be provided")
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results := make([]*batchResult, len(input.Operations))
+	for i, op := range input.Operations {
+		results[i] = &batchResult{Index: i, Op: op.Op, Status: batchSkipped, ID: op.ID}
+	}
+
+	err = app.models.Books.Batch(func(tx data.BookTx) error {
+		for i, op := range input.Operations {
+			result := results[i]
+
+			switch op.Op {
+			case "create":
+				book := &data.Book{}
+				op.Book.apply(book)
+
+				v := validator.New()
+				if data.ValidateBook(v, book); !v.Valid() {
+					return &batchError{index: i, status: http.StatusUnprocessableEntity, errors: v.Errors}
+				}
+
+				err := tx.Insert(book)
+				if err != nil {
+					return app.batchOperationError(i, err)
+				}
+				result.Status, result.ID, result.Book = batchCreated, book.ID, book
+
+			case "update":
+				book, err := tx.Get(op.ID)
+				if err != nil {
+					return app.batchOperationError(i, err)
+				}
+				if book.Version != op.Version {
+					return app.batchOperationError(i, data.ErrEditConflict)
+				}
+				op.Book.apply(book)
+
+				v := validator.New()
+				if data.ValidateBook(v, book); !v.Valid() {
+					return &batchError{index: i, status: http.StatusUnprocessableEntity, errors: v.Errors}
+				}
+
+				err = tx.Update(book)
+				if err != nil {
+					return app.batchOperationError(i, err)
+				}
+				result.Status, result.Book = batchUpdated, book
+
+			case "delete":
+				err := tx.Delete(op.ID, op.Version)
+				if err != nil {
+					return app.batchOperationError(i, err)
+				}
+				result.Status = batchDeleted
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		var batchErr *batchError
+		if !errors.As(err, &batchErr) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Nothing from the batch was kept, so report the operations before the failed
+		// one as rolled back and drop the data which no longer exists.
+		for _, result := range results[:batchErr.index] {
+			result.Status, result.Book = batchRolledBack, nil
+			if result.Op == "create" {
+				result.ID = 0
+			}
+		}
+		results[batchErr.index].Status = batchFailed
+		results[batchErr.index].Errors = batchErr.errors
+
+		env := envelope{
+			"error":   fmt.Sprintf("operation %d failed, no changes were applied", batchErr.index),
+			"results": results,
+		}
+		err = app.writeJSON(w, batchErr.status, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The batchOperationError() helper converts the error from a single batch operation
+// into a batchError with the matching status code. Unexpected errors are passed
+// through unchanged, so that they end up as a 500 Internal Server Error response.
+func (app *application) batchOperationError(index int, err error) error {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return &batchError{index: index, status: http.StatusNotFound, errors: map[string]string{"id": "the requested resource could not be found"}}
+	case errors.Is(err, data.ErrEditConflict):
+		return &batchError{index: index, status: http.StatusConflict, errors: map[string]string{"version": "the record has been changed since this version"}}
+	case errors.Is(err, data.ErrUnknownGenre):
+		return &batchError{index: index, status: http.StatusUnprocessableEntity, errors: map[string]string{"genres": "must only contain known genres"}}
+	default:
+		return err
+	}
+}
@@ -13,8 +13,9 @@ func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request)
 	// To keep things consistent with our other handlers, we'll define an input struct
 	// to hold the expected values from the request query string.
 	var input struct {
-		Title  string
-		Genres []string
+		Title    string
+		Genres   []string
+		Language string
 		data.Filters
 	}
 	// Initialize a new Validator instance.
@@ -26,6 +27,17 @@ func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request)
 	// provided by the client.
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Language = app.readString(qs, "language", "")
+	if input.Language != "" {
+		data.ValidateLanguage(v, input.Language)
+	}
+	// Restrict the listing to books with a copy available at the branch, if one is
+	// given.
+	branchID, err := app.readBranchFilter(qs, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	// Get the page and page_size query string values as integers. Notice that we set
 	// the default page value to 1 and default page_size to 20, and that we pass the
 	// validator instance as the final argument here.
@@ -36,7 +48,7 @@ func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request)
 	input.Sort = app.readString(qs, "sort", "id")
 
 	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Filters.SortSafelist = []string{"id", "title", "year", "pageCount", "-id", "-title", "-year", "-pageCount"}
+	input.Filters.SortSafelist = []string{"id", "title", "year", "pageCount", "rating", "-id", "-title", "-year", "-pageCount", "-rating"}
 	// Execute the validation checks on the Filters struct and send a response
 	// containing the errors if necessary.
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
@@ -47,7 +59,18 @@ func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request)
 	// Call the GetAll() method to retrieve the books, passing in the various filter
 	// parameters.
 	// Accept the metadata struct as a return value.
-	books, metadata, err := app.models.Books.GetAll(input.Title, input.Genres, input.Filters)
+	books, metadata, err := app.models.Books.GetAll(input.Title, input.Genres, input.Language, branchID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Include the shelf status of each book for the authenticated user.
+	err = app.attachShelves(r, books...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.attachAvailability(branchID, books...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -65,6 +88,8 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 		Year      int32    `json:"year"`
 		PageCount int32    `json:"pageCount"`
 		Genres    []string `json:"genres"`
+		ISBN      string   `json:"isbn"`
+		Language  string   `json:"language"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -78,6 +103,8 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 		Year:      input.Year,
 		PageCount: input.PageCount,
 		Genres:    input.Genres,
+		ISBN:      data.NormalizeISBN(input.ISBN),
+		Language:  input.Language,
 	}
 
 	// Initialize a new Validator.
@@ -94,7 +121,13 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 	// book struct with the system-generated information.
 	err = app.models.Books.Insert(book)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrUnknownGenre):
+			v.AddError("genres", "must only contain known genres")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 	// When sending a HTTP response, we want to include a Location header to let the
@@ -120,16 +153,39 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	v := validator.New()
+	branchID, err := app.readBranchFilter(r.URL.Query(), v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	book, err := app.models.Books.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
+			// The book may have been merged into another one, in which case we
+			// redirect the client to the surviving book.
+			app.redirectMergedBook(w, r, id)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+	err = app.attachShelves(r, book)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.attachAvailability(branchID, book)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
 
 	if err != nil {
@@ -138,6 +194,41 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 
 }
 
+// bookInput holds the fields of a book that a client can set. The fields are pointers
+// so that we can tell a field which was left out of a partial update apart from one
+// which was set to its zero value.
+type bookInput struct {
+	Title     *string  `json:"title"`
+	Year      *int32   `json:"year"`
+	PageCount *int32   `json:"pageCount"`
+	Genres    []string `json:"genres"`
+	ISBN      *string  `json:"isbn"`
+	Language  *string  `json:"language"`
+}
+
+// apply() copies the fields which were provided in the input onto the book.
+func (input bookInput) apply(book *data.Book) {
+	if input.Title != nil {
+		book.Title = *input.Title
+	}
+	// We also do the same for the other fields in the input struct.
+	if input.Year != nil {
+		book.Year = *input.Year
+	}
+	if input.PageCount != nil {
+		book.PageCount = *input.PageCount
+	}
+	if input.Genres != nil {
+		book.Genres = input.Genres // Note that we don't need to dereference a slice.
+	}
+	if input.ISBN != nil {
+		book.ISBN = data.NormalizeISBN(*input.ISBN)
+	}
+	if input.Language != nil {
+		book.Language = *input.Language
+	}
+}
+
 func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -157,32 +248,13 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	type Input struct {
-		Title     *string  `json:"title"`
-		Year      *int32   `json:"year"`
-		PageCount *int32   `json:"pageCount"`
-		Genres    []string `json:"genres"`
-	}
-
-	var input Input
+	var input bookInput
 	err = app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 	}
 
-	if input.Title != nil {
-		book.Title = *input.Title
-	}
-	// We also do the same for the other fields in the input struct.
-	if input.Year != nil {
-		book.Year = *input.Year
-	}
-	if input.PageCount != nil {
-		book.PageCount = *input.PageCount
-	}
-	if input.Genres != nil {
-		book.Genres = input.Genres // Note that we don't need to dereference a slice.
-	}
+	input.apply(book)
 
 	v := validator.New()
 	if data.ValidateBook(v, book); !v.Valid() {
@@ -195,6 +267,9 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrUnknownGenre):
+			v.AddError("genres", "must only contain known genres")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
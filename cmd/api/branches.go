@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+func (app *application) listBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	branches, err := app.models.Branches.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"branches": branches}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createBranchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	branch := &data.Branch{
+		Name:    input.Name,
+		Address: input.Address,
+	}
+
+	v := validator.New()
+	if data.ValidateBranch(v, branch); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Branches.Insert(branch)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateBranch):
+			v.AddError("name", "a branch with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/branches/%d", branch.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"branch": branch}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showBranchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	branch, err := app.models.Branches.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"branch": branch}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateBranchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	branch, err := app.models.Branches.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name    *string `json:"name"`
+		Address *string `json:"address"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		branch.Name = *input.Name
+	}
+	if input.Address != nil {
+		branch.Address = *input.Address
+	}
+
+	v := validator.New()
+	if data.ValidateBranch(v, branch); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Branches.Update(branch)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateBranch):
+			v.AddError("name", "a branch with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"branch": branch}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteBranchHandler() deletes a branch. Branches which still hold copies, or
+// which have transfer or stocktake history, are kept and a 409 Conflict response is
+// sent instead.
+func (app *application) deleteBranchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Branches.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrBranchInUse):
+			message := "the branch still has copies, transfers or stocktakes and cannot be deleted"
+			app.errorResponse(w, r, http.StatusConflict, message)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "branch successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readBranchFilter() helper reads the optional "branch" query string value, which
+// restricts a listing to what is available at that branch. It returns 0 if no branch
+// was given, and records a validation error if the branch doesn't exist.
+func (app *application) readBranchFilter(qs url.Values, v *validator.Validator) (int64, error) {
+	branchID := int64(app.readInt(qs, "branch", 0, v))
+	if branchID == 0 {
+		return 0, nil
+	}
+
+	_, err := app.models.Branches.Get(branchID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("branch", "must be an existing branch")
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+	return branchID, nil
+}
@@ -15,6 +15,9 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// tokenContextKey is the key for the plaintext authentication token of the request.
+const tokenContextKey = contextKey("token")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -34,3 +37,39 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// requestToken is the authentication token of a request and the login family it
+// belongs to. Tokens issued to OAuth clients and API keys have no family; instead they
+// are limited to the permissions in scopes, and OAuth tokens record their client. The
+// scopes of our own tokens are nil, as they carry all of the user's permissions.
+type requestToken struct {
+	plaintext string
+	family    string
+	clientID  string
+	scopes    data.Permissions
+}
+
+// The contextSetToken() method returns a new copy of the request with the plaintext
+// authentication token and its family added to the context, so that handlers can act
+// on the current session.
+func (app *application) contextSetToken(r *http.Request, token, family string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, requestToken{plaintext: token, family: family})
+	return r.WithContext(ctx)
+}
+
+// The contextSetScopedToken() method is like contextSetToken(), for tokens which only
+// grant the permissions in scopes.
+func (app *application) contextSetScopedToken(r *http.Request, token, clientID string, scopes data.Permissions) *http.Request {
+	if scopes == nil {
+		scopes = data.Permissions{}
+	}
+	ctx := context.WithValue(r.Context(), tokenContextKey, requestToken{plaintext: token, clientID: clientID, scopes: scopes})
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() retrieves the authentication token from the request context.
+// Both fields are empty for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) requestToken {
+	token, _ := r.Context().Value(tokenContextKey).(requestToken)
+	return token
+}
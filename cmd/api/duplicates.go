@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+func (app *application) listDuplicateBooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MinSimilarity float64
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.MinSimilarity = app.readFloat(qs, "min_similarity", 0.6, v)
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Candidates are always sorted by score, so "score" is the only accepted value.
+	input.Sort = app.readString(qs, "sort", "score")
+	input.Filters.SortSafelist = []string{"score"}
+
+	// The lower bound matches the default pg_trgm similarity threshold, below which
+	// the title index isn't used to find candidates.
+	v.Check(input.MinSimilarity >= 0.3, "min_similarity", "must be at least 0.3")
+	v.Check(input.MinSimilarity <= 1, "min_similarity", "must be at most 1")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	duplicates, metadata, err := app.models.Books.GetDuplicates(input.MinSimilarity, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"duplicates": duplicates, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The mergeBookHandler() merges the book in the URL into the surviving book given in
+// the request body. The merged book's ID keeps resolving to the surviving book.
+func (app *application) mergeBookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Into int64 `json:"into"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Into > 0, "into", "must be provided")
+	v.Check(input.Into != id, "into", "must be a different book")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	book, err := app.models.Books.Merge(id, input.Into)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The redirectMergedBook() helper sends a 301 Moved Permanently response pointing at
+// the surviving book if the requested book was merged away, and a 404 Not Found
+// response otherwise. The surviving book is included in the body as well, so that
+// clients which don't follow redirects still get the data.
+func (app *application) redirectMergedBook(w http.ResponseWriter, r *http.Request, id int64) {
+	newID, err := app.models.Books.GetRedirect(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	book, err := app.models.Books.Get(newID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.attachShelves(r, book)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/books/%d", book.ID))
+
+	err = app.writeJSON(w, http.StatusMovedPermanently, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/xarafeddine/maktaba/internal/blobstore"
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/signedurl"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// maxEbookSize is the largest ebook file that can be uploaded.
+const maxEbookSize = 200 << 20
+
+// ebookSignatures holds the bytes that every file of each ebook format starts with.
+// EPUB files are ZIP archives.
+var ebookSignatures = map[string][]byte{
+	"epub": []byte("PK\x03\x04"),
+	"pdf":  []byte("%PDF-"),
+}
+
+// The uploadEbookHandler() attaches a digital file to a book. The file is sent as the
+// raw request body, with the format, filename and number of licenses in the query
+// string, for example:
+//
+//	POST /v1/books/1/ebooks?format=epub&filename=dune.epub&licenses=3
+func (app *application) uploadEbookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	ebook := &data.Ebook{
+		BookID:   id,
+		Format:   app.readString(qs, "format", ""),
+		Filename: app.readString(qs, "filename", ""),
+		Licenses: int32(app.readInt(qs, "licenses", 1, v)),
+	}
+	if data.ValidateEbook(v, ebook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	ebook.ContentType = data.EbookContentTypes[ebook.Format]
+
+	// Check the start of the file before storing it, so that a mislabelled upload is
+	// rejected without being written to disk.
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxEbookSize))
+	signature := ebookSignatures[ebook.Format]
+	head, _ := body.Peek(len(signature))
+	if v.Check(bytes.Equal(head, signature), "file", "must be a valid "+ebook.Format+" file"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ebook.BlobKey, ebook.Size, err = app.blobs.Put(body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.errorResponse(w, r, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("the file must not be larger than %d bytes", maxBytesError.Limit))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Ebooks.Insert(ebook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/ebooks/%d", ebook.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"ebook": ebook}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listBookEbooksHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Books.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ebooks, err := app.models.Ebooks.GetAllForBook(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"ebooks": ebooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showEbookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ebook, err := app.models.Ebooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"ebook": ebook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateEbookHandler() changes the filename or number of licenses of an ebook. The
+// file itself can't be replaced; upload a new ebook and delete the old one instead.
+func (app *application) updateEbookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ebook, err := app.models.Ebooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Filename *string `json:"filename"`
+		Licenses *int32  `json:"licenses"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Filename != nil {
+		ebook.Filename = *input.Filename
+	}
+	if input.Licenses != nil {
+		ebook.Licenses = *input.Licenses
+	}
+
+	v := validator.New()
+	if data.ValidateEbook(v, ebook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Ebooks.Update(ebook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"ebook": ebook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteEbookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Ebooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ebook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createEbookLoanHandler() lends an ebook to the authenticated user, if one of its
+// licenses is free, and responds with a download link for the file.
+func (app *application) createEbookLoanHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	loan := &data.EbookLoan{
+		UserID: user.ID,
+		DueAt:  time.Now().Add(app.config.ebooks.loanPeriod).Truncate(time.Second),
+		Ebook:  &data.Ebook{ID: id},
+	}
+
+	err = app.models.EbookLoans.Insert(loan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrAlreadyBorrowed):
+			app.errorResponse(w, r, http.StatusConflict, "you already have this ebook on loan")
+		case errors.Is(err, data.ErrNoLicenseAvailable):
+			app.errorResponse(w, r, http.StatusConflict, "all licenses for this ebook are on loan, please try again later")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.signDownloadURL(loan)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"loan": loan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listEbookLoansHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	loans, err := app.models.EbookLoans.GetAllActiveForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"loans": loans}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createEbookLinkHandler() issues a fresh download link for one of the user's
+// active loans, as the links expire long before the loan does.
+func (app *application) createEbookLinkHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	loan, err := app.models.EbookLoans.GetActiveForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.signDownloadURL(loan)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"loan": loan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The returnEbookLoanHandler() ends a loan early so that someone else can borrow the
+// ebook. Download links already issued for the loan keep working until they expire.
+func (app *application) returnEbookLoanHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.EbookLoans.Return(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ebook successfully returned"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The signDownloadURL() helper sets the download link of a loan. The link carries
+// everything needed to serve the file, so downloads don't touch the database. It
+// expires after the configured lifetime, or when the loan falls due if that is sooner.
+func (app *application) signDownloadURL(loan *data.EbookLoan) {
+	expires := time.Now().Add(app.config.ebooks.linkTTL)
+	if loan.DueAt.Before(expires) {
+		expires = loan.DueAt
+	}
+
+	params := url.Values{}
+	params.Set("name", loan.Ebook.Filename)
+	params.Set("type", loan.Ebook.ContentType)
+
+	loan.DownloadURL = app.downloads.Sign("/v1/downloads/"+loan.Ebook.BlobKey, params, expires)
+}
+
+// The downloadHandler() serves an ebook file to anyone holding a valid download link.
+// http.ServeContent() takes care of Range and conditional requests, so readers can
+// resume interrupted downloads.
+func (app *application) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	err := app.downloads.Verify(r.URL.Path, qs, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, signedurl.ErrExpired):
+			app.errorResponse(w, r, http.StatusGone, "the download link has expired, please request a new one")
+		default:
+			app.errorResponse(w, r, http.StatusForbidden, "invalid download link")
+		}
+		return
+	}
+
+	key := httprouter.ParamsFromContext(r.Context()).ByName("key")
+	f, err := app.blobs.Open(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, blobstore.ErrNotFound), errors.Is(err, blobstore.ErrInvalidKey):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The content is addressed by its hash, so it never changes for a given key and
+	// can be cached by the client until the link expires.
+	expires, _ := strconv.ParseInt(qs.Get("exp"), 10, 64)
+	maxAge := max(expires-time.Now().Unix(), 0)
+
+	w.Header().Set("Content-Type", qs.Get("type"))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": qs.Get("name")}))
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("ETag", `"`+key+`"`)
+
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
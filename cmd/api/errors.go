@@ -97,7 +97,48 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) bannedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been banned"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) deactivatedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been deactivated by an administrator"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this account has two-factor authentication enabled, please also send a totp_code or recovery_code"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) twoFactorEnrollmentRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must have two-factor authentication enabled to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) insufficientScopeResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your access token's scopes don't allow access to this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// The oauthErrorResponse() method sends an error from the OAuth token endpoint, which
+// has the format set out in RFC 6749, section 5.2, rather than our usual one.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	env := envelope{"error": code, "error_description": description}
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	err := app.writeJSON(w, status, env, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
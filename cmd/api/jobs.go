@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// The startJobs() method launches the periodic background jobs. They keep running
+// until the ctx is cancelled, which serve() does when the server is shutting down.
+func (app *application) startJobs(ctx context.Context) {
+	if app.config.recommender.enabled {
+		app.daily(ctx, "recompute recommendations", app.config.recommender.hour, app.recomputeRecommendations)
+	}
+	app.daily(ctx, "delete accounts", app.config.accounts.deletionHour, app.deleteAccounts)
+}
+
+// The daily() helper runs fn once a day at the given hour (UTC). Each run goes through
+// the background() helper, so that a graceful shutdown waits for a run which is
+// already in progress to wind down (the ctx passed to fn is cancelled at shutdown).
+func (app *application) daily(ctx context.Context, name string, hour int, fn func(ctx context.Context) error) {
+	go func() {
+		for {
+			now := time.Now().UTC()
+			next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+
+			timer := time.NewTimer(next.Sub(now))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			app.background(func() {
+				start := time.Now()
+				app.logger.Info("starting job", "job", name)
+				err := fn(ctx)
+				if err != nil {
+					app.logger.Error(err.Error(), "job", name)
+					return
+				}
+				app.logger.Info("completed job", "job", name, "duration", time.Since(start).String())
+			})
+		}
+	}()
+}
+
+func (app *application) recomputeRecommendations(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	pairs, err := app.models.Recommendations.Recompute(ctx)
+	if err != nil {
+		return err
+	}
+	app.logger.Info("recomputed book similarities", "pairs", pairs)
+	return nil
+}
+
+// The deleteAccounts() job deletes the accounts whose grace period has ended.
+func (app *application) deleteAccounts(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	deleted, err := app.models.Users.DeleteScheduled(ctx)
+	if err != nil {
+		return err
+	}
+	app.logger.Info("deleted accounts", "accounts", deleted)
+	return nil
+}
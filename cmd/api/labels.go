@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/xarafeddine/maktaba/internal/barcode"
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+var labelsTemplate = template.Must(template.ParseFS(templateFS, "templates/labels.tmpl"))
+
+// The showCopyLabelHandler() renders the barcode of a copy. The "format" query string
+// value selects between "svg" (the default), which includes the human-readable barcode
+// below the bars, and "png".
+func (app *application) showCopyLabelHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	format := app.readString(r.URL.Query(), "format", "svg")
+	if v.Check(validator.PermittedValue(format, "svg", "png"), "format", "must be svg or png"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	copy, err := app.models.Copies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	code, err := barcode.Encode(copy.Barcode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Render into a buffer first, so that we can still send an error response if
+	// something goes wrong.
+	var buf bytes.Buffer
+	contentType := "image/svg+xml"
+	if format == "png" {
+		contentType = "image/png"
+		err = code.PNG(&buf, barcode.DefaultOptions)
+	} else {
+		err = code.SVG(&buf, barcode.DefaultOptions)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// The printCopyLabelsHandler() lays out the labels of the copies given in the "ids"
+// query string value on a printable HTML page, in the order given.
+func (app *application) printCopyLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	csv := app.readCSV(r.URL.Query(), "ids", []string{})
+
+	ids := make([]int64, 0, len(csv))
+	for _, s := range csv {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 1 {
+			v.AddError("ids", "must only contain positive integers")
+			break
+		}
+		ids = append(ids, id)
+	}
+	v.Check(len(csv) >= 1, "ids", "must contain at least 1 copy")
+	v.Check(len(csv) <= 300, "ids", "must not contain more than 300 copies")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	labels, err := app.models.Copies.GetLabels(ids)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	type labelData struct {
+		*data.CopyLabel
+		SVG template.HTML
+	}
+	page := make([]labelData, len(labels))
+	for i, label := range labels {
+		code, err := barcode.Encode(label.Barcode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		var svg bytes.Buffer
+		err = code.SVG(&svg, barcode.DefaultOptions)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// The SVG is generated by our own barcode package, with the data escaped, so
+		// it is safe to include in the page as-is.
+		page[i] = labelData{CopyLabel: label, SVG: template.HTML(svg.String())}
+	}
+
+	var buf bytes.Buffer
+	err = labelsTemplate.Execute(&buf, page)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
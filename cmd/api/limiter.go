@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// keyedLimiter rate limits actions per key, such as an email address, in the same way
+// that the rateLimit() middleware limits requests per IP address. Keys which haven't
+// been seen for the idle duration are forgotten.
+type keyedLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*keyedClient
+}
+
+type keyedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiter(limit rate.Limit, burst int, idle time.Duration) *keyedLimiter {
+	l := &keyedLimiter{
+		limit:   limit,
+		burst:   burst,
+		clients: make(map[string]*keyedClient),
+	}
+
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+			l.mu.Lock()
+			for key, client := range l.clients {
+				if time.Since(client.lastSeen) > idle {
+					delete(l.clients, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	return l
+}
+
+// Allow reports whether the action may happen now for the given key.
+func (l *keyedLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, found := l.clients[key]
+	if !found {
+		client = &keyedClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = time.Now()
+	return client.limiter.Allow()
+}
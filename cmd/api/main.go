@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"expvar"
 	"fmt"
 	"runtime"
@@ -12,6 +13,7 @@ import (
 	"database/sql" // New import
 	"flag"
 	"log/slog"
+	"net/http"
 	"os"
 	"time"
 
@@ -19,8 +21,13 @@ import (
 	// package. Note that we alias this import to the blank identifier, to stop the Go
 	// compiler complaining that the package isn't being used.
 	_ "github.com/lib/pq"
+	"github.com/xarafeddine/maktaba/internal/auth"
+	"github.com/xarafeddine/maktaba/internal/blobstore"
 	"github.com/xarafeddine/maktaba/internal/data"
 	"github.com/xarafeddine/maktaba/internal/mailer"
+	"github.com/xarafeddine/maktaba/internal/oidc"
+	"github.com/xarafeddine/maktaba/internal/signedurl"
+	"golang.org/x/time/rate"
 )
 
 const version = "1.0.0"
@@ -54,6 +61,45 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+
+	recommender struct {
+		enabled bool
+		hour    int
+	}
+
+	accounts struct {
+		// deletionGrace is how long deleted accounts are kept, so that users can change
+		// their mind, before the daily job at deletionHour deletes them for good.
+		deletionGrace time.Duration
+		deletionHour  int
+	}
+
+	auth struct {
+		backend         string
+		keys            []auth.Key
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+		// statusTTL is how long stateless tokens trust a cached lookup of whether
+		// their user is activated and banned.
+		statusTTL time.Duration
+		// twoFactorPermissions lists the permissions which can only be used by users
+		// with two-factor authentication enabled.
+		twoFactorPermissions []string
+	}
+
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+	}
+
+	ebooks struct {
+		blobDir        string
+		downloadSecret string
+		linkTTL        time.Duration
+		loanPeriod     time.Duration
+	}
 }
 
 type application struct {
@@ -61,7 +107,17 @@ type application struct {
 	logger *slog.Logger
 	models data.Models
 	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	tokens auth.Issuer
+	// oidc is the OpenID Connect provider users can log in with, or nil if none is
+	// configured.
+	oidc      *oidc.Provider
+	blobs     *blobstore.Store
+	downloads signedurl.Signer
+	// activationLimiter limits how often activation emails are resent to an address.
+	activationLimiter *keyedLimiter
+	// twoFactorLimiter limits how often each user's second factor can be tried.
+	twoFactorLimiter *keyedLimiter
+	wg               sync.WaitGroup
 }
 
 func main() {
@@ -93,6 +149,37 @@ func main() {
 		return nil
 	})
 
+	flag.BoolVar(&cfg.recommender.enabled, "recommender-enabled", true, "Enable the nightly recommendations job")
+	flag.IntVar(&cfg.recommender.hour, "recommender-hour", 3, "Hour of the day (UTC) to recompute recommendations")
+
+	flag.DurationVar(&cfg.accounts.deletionGrace, "account-deletion-grace", 30*24*time.Hour, "How long deleted accounts can still be restored")
+	flag.IntVar(&cfg.accounts.deletionHour, "account-deletion-hour", 4, "Hour of the day (UTC) to delete accounts whose grace period has ended")
+
+	flag.StringVar(&cfg.auth.backend, "token-backend", "database", "Authentication token backend (database|stateless)")
+	flag.Func("token-keys", "Ed25519 keys for stateless tokens, as space separated id:base64-seed pairs (the first signs new tokens)", func(val string) error {
+		keys, err := auth.ParseKeys(val)
+		cfg.auth.keys = keys
+		return err
+	})
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-token-ttl", 24*time.Hour, "Lifetime of authentication tokens")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.DurationVar(&cfg.auth.statusTTL, "token-status-ttl", time.Minute, "How long stateless tokens cache whether their user is activated and banned")
+
+	flag.Func("two-factor-permissions", "Permissions which require two-factor authentication (space separated)", func(val string) error {
+		cfg.auth.twoFactorPermissions = strings.Fields(val)
+		return nil
+	})
+
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect provider issuer URL (disables OIDC login if empty)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "URL the OpenID Connect provider sends users back to")
+
+	flag.StringVar(&cfg.ebooks.blobDir, "blob-dir", "./blobs", "Directory for storing ebook files")
+	flag.StringVar(&cfg.ebooks.downloadSecret, "download-secret", "", "Secret key for signing ebook download links")
+	flag.DurationVar(&cfg.ebooks.linkTTL, "download-link-ttl", 15*time.Minute, "Lifetime of ebook download links")
+	flag.DurationVar(&cfg.ebooks.loanPeriod, "ebook-loan-period", 14*24*time.Hour, "Length of ebook loans")
+
 	// Create a new version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 	flag.Parse()
@@ -135,11 +222,58 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	blobs, err := blobstore.New(cfg.ebooks.blobDir)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Download links are signed with the secret, so they stop working whenever it
+	// changes. Without a configured secret we use a random one, which means that links
+	// don't survive a restart and aren't accepted by other instances of the API.
+	secret := []byte(cfg.ebooks.downloadSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		logger.Warn("no download secret configured, using a random one")
+	}
+
+	models := data.NewModels(db)
+
+	tokens, err := newTokenIssuer(cfg, models, logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	var provider *oidc.Provider
+	if cfg.oidc.issuer != "" {
+		provider = oidc.New(oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+			Scopes:       []string{"email", "profile"},
+			HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:    cfg,
+		logger:    logger,
+		models:    models,
+		mailer:    mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		tokens:    tokens,
+		oidc:      provider,
+		blobs:     blobs,
+		downloads: signedurl.New(secret),
+
+		activationLimiter: newKeyedLimiter(rate.Every(5*time.Minute), 1, 5*time.Minute),
+		twoFactorLimiter:  newKeyedLimiter(rate.Every(5*time.Minute), 5, 30*time.Minute),
 	}
 
 	err = app.serve()
@@ -149,6 +283,30 @@ func main() {
 	}
 }
 
+// The newTokenIssuer() function returns the authentication token backend selected by
+// the configuration.
+func newTokenIssuer(cfg config, models data.Models, logger *slog.Logger) (auth.Issuer, error) {
+	switch cfg.auth.backend {
+	case "database":
+		return auth.DatabaseIssuer{Models: models}, nil
+	case "stateless":
+		// Without configured keys we sign with a random one, which means that tokens
+		// don't survive a restart and aren't accepted by other instances of the API.
+		keys := cfg.auth.keys
+		if len(keys) == 0 {
+			key, err := auth.GenerateKey("ephemeral")
+			if err != nil {
+				return nil, err
+			}
+			keys = []auth.Key{key}
+			logger.Warn("no token keys configured, using a random one")
+		}
+		return auth.NewStatelessIssuer(keys, cfg.auth.accessTokenTTL, models.Users, cfg.auth.statusTTL)
+	default:
+		return nil, fmt.Errorf("unknown token backend %q", cfg.auth.backend)
+	}
+}
+
 // The openDB() function returns a sql.DB connection pool.
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the config
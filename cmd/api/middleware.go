@@ -5,12 +5,14 @@ import (
 	"expvar"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/tomasen/realip"
+	"github.com/xarafeddine/maktaba/internal/auth"
 	"github.com/xarafeddine/maktaba/internal/data"
 	"github.com/xarafeddine/maktaba/internal/validator"
 	"golang.org/x/time/rate"
@@ -117,43 +119,91 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// using the invalidAuthenticationTokenResponse() helper (which we will create
 		// in a moment).
 		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		if len(headerParts) != 2 || (headerParts[0] != "Bearer" && headerParts[0] != "ApiKey") {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
-		// Extract the actual authentication token from the header parts.
-		token := headerParts[1]
-		// Validate the token to make sure it is in a sensible format.
-		v := validator.New()
-		// If the token isn't valid, use the invalidAuthenticationTokenResponse()
-		// helper to send a response, rather than the failedValidationResponse() helper
-		// that we'd normally use.
-		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
+		// Service accounts send an API key as "ApiKey <key>" instead.
+		if headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
 			return
 		}
-		// Retrieve the details of the user associated with the authentication token,
-		// again calling the invalidAuthenticationTokenResponse() helper if no
-		// matching record was found. IMPORTANT: Notice that we are using
-		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		// Extract the actual authentication token from the header parts.
+		token := headerParts[1]
+		// Retrieve the details of the user associated with the authentication token
+		// from the configured token backend, calling the
+		// invalidAuthenticationTokenResponse() helper if the token isn't valid.
+		identity, err := app.tokens.Authenticate(token)
 		if err != nil {
 			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
+			case errors.Is(err, auth.ErrInvalidToken):
+				// The token may instead have been issued to an OAuth client.
+				app.authenticateOAuthToken(w, r, next, token)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
 			return
 		}
 		// Call the contextSetUser() helper to add the user information to the request
-		// context.
-		r = app.contextSetUser(r, user)
+		// context, along with the token for handlers that manage the current session.
+		r = app.contextSetUser(r, identity.User)
+		r = app.contextSetToken(r, token, identity.Family)
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The authenticateOAuthToken() helper authenticates a request made with an access
+// token issued to an OAuth client. The token acts on behalf of the user who authorized
+// the client, but only for the permissions in its scopes.
+func (app *application) authenticateOAuthToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user, oauthToken, err := app.models.OAuth.GetForToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetScopedToken(r, token, oauthToken.ClientID, oauthToken.Scopes)
+	next.ServeHTTP(w, r)
+}
+
+// The authenticateAPIKey() helper authenticates a request made with an API key, which
+// acts on behalf of the user who created it, but only for the permissions in its
+// scopes.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, key string) {
+	if !data.ValidAPIKeyPlaintext(key) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user, apiKey, err := app.models.APIKeys.GetForKey(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetScopedToken(r, key, "", apiKey.Scopes)
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -161,6 +211,16 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 			app.authenticationRequiredResponse(w, r)
 			return
 		}
+		if user.IsBanned() {
+			app.bannedAccountResponse(w, r)
+			return
+		}
+		// Tokens limited to scopes can only be used on endpoints which require a
+		// permission, as that is what their scopes grant.
+		if app.contextGetToken(r).scopes != nil {
+			app.insufficientScopeResponse(w, r)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -183,8 +243,21 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
+		// Retrieve the user from the request context, and check that they are
+		// authenticated and activated in the same way as requireActivatedUser().
 		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+		if user.IsBanned() {
+			app.bannedAccountResponse(w, r)
+			return
+		}
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
 		// Get the slice of permissions for the user.
 		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
 		if err != nil {
@@ -197,12 +270,31 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			app.notPermittedResponse(w, r)
 			return
 		}
+		// Tokens limited to scopes also need the permission among their scopes.
+		if scopes := app.contextGetToken(r).scopes; scopes != nil && !scopes.Include(code) {
+			app.insufficientScopeResponse(w, r)
+			return
+		}
+		// Permissions which are configured to need two-factor authentication can only
+		// be used once the user has enabled it.
+		if slices.Contains(app.config.auth.twoFactorPermissions, code) {
+			enabled, err := app.models.TOTP.Enabled(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			if !enabled {
+				app.twoFactorEnrollmentRequiredResponse(w, r)
+				return
+			}
+		}
 		// Otherwise they have the required permission so we call the next handler in
 		// the chain.
 		next.ServeHTTP(w, r)
 	}
-	// Wrap this with the requireActivatedUser() middleware before returning it.
-	return app.requireActivatedUser(fn)
+	// Unlike other endpoints for activated users, this one accepts tokens limited to
+	// scopes, so fn isn't wrapped with the requireActivatedUser() middleware.
+	return fn
 }
 
 func (app *application) enableCORS(next http.Handler) http.Handler {
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// oauthCodeTTL is how long clients have to exchange an authorization code.
+const oauthCodeTTL = 10 * time.Minute
+
+// The createOAuthClientHandler() registers a third-party app. The client secret of
+// confidential clients is only shown in this response.
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	client, secret, err := data.NewOAuthClient(user.ID, input.Name, input.RedirectURIs, input.Scopes, input.Confidential)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateOAuthClient(v, client)
+	if v.Valid() {
+		// Scopes are permission codes, so check that they exist.
+		permissions, err := app.models.Permissions.GetAll()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, scope := range client.Scopes {
+			v.Check(permissions.Include(scope), "scopes", "must only contain permission codes")
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.OAuth.InsertClient(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"client": client}
+	if client.Confidential {
+		env["client_secret"] = secret
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listOAuthClientsHandler() lists the clients the user has registered.
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	clients, err := app.models.OAuth.GetClientsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := httprouter.ParamsFromContext(r.Context()).ByName("client_id")
+	user := app.contextGetUser(r)
+
+	err := app.models.OAuth.DeleteClient(clientID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizationRequest is a checked request from a client for an authorization code.
+type authorizationRequest struct {
+	client        *data.OAuthClient
+	redirectURI   string
+	scopes        []string
+	state         string
+	codeChallenge string
+}
+
+// The readAuthorizationRequest() helper reads and checks the query string parameters of
+// an authorization request (RFC 6749, section 4.1.1). PKCE with the S256 method is
+// required of every client. As our frontend shows the consent screen, problems are
+// reported to it as validation errors rather than by redirecting to the client.
+func (app *application) readAuthorizationRequest(r *http.Request, v *validator.Validator) (*authorizationRequest, error) {
+	qs := r.URL.Query()
+
+	client, err := app.models.OAuth.GetClient(qs.Get("client_id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "must be a registered client")
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	req := &authorizationRequest{
+		client:        client,
+		redirectURI:   qs.Get("redirect_uri"),
+		scopes:        strings.Fields(qs.Get("scope")),
+		state:         qs.Get("state"),
+		codeChallenge: qs.Get("code_challenge"),
+	}
+	// The redirect URI can be left out if the client only registered one.
+	if req.redirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.redirectURI = client.RedirectURIs[0]
+	}
+	// Without a scope parameter, the client asks for every scope it registered.
+	if len(req.scopes) == 0 {
+		req.scopes = client.Scopes
+	}
+
+	v.Check(slices.Contains(client.RedirectURIs, req.redirectURI), "redirect_uri", "must be one of the client's redirect URIs")
+	v.Check(qs.Get("response_type") == "code", "response_type", "must be code")
+	v.Check(validator.Unique(req.scopes), "scope", "must not contain duplicate values")
+	for _, scope := range req.scopes {
+		v.Check(slices.Contains(client.Scopes, scope), "scope", "must only contain scopes registered by the client")
+	}
+	v.Check(validator.Matches(req.codeChallenge, data.CodeVerifierRX), "code_challenge", "must be provided")
+	v.Check(qs.Get("code_challenge_method") == "S256", "code_challenge_method", "must be S256")
+	return req, nil
+}
+
+// The showAuthorizationHandler() checks an authorization request and describes it, so
+// that the frontend can ask the user for consent. Consented is true if the user has
+// already given the client all of the requested scopes.
+func (app *application) showAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	req, err := app.readAuthorizationRequest(r, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	consented := false
+	scopes, err := app.models.OAuth.GetConsent(user.ID, req.client.ID)
+	switch {
+	case err == nil:
+		consented = true
+		for _, scope := range req.scopes {
+			consented = consented && scopes.Include(scope)
+		}
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authorization": map[string]any{
+		"client_id":    req.client.ID,
+		"client_name":  req.client.Name,
+		"redirect_uri": req.redirectURI,
+		"scopes":       req.scopes,
+		"consented":    consented,
+	}}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The authorizeHandler() records the user's answer to an authorization request, which
+// is sent with the same query string as to showAuthorizationHandler(). It responds
+// with the URI to send the user back to the client with, carrying either an
+// authorization code or an access_denied error.
+func (app *application) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Approve *bool `json:"approve"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Approve != nil, "approve", "must be provided")
+	req, err := app.readAuthorizationRequest(r, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	params := url.Values{}
+	if *input.Approve {
+		code := &data.OAuthCode{
+			ClientID:      req.client.ID,
+			UserID:        app.contextGetUser(r).ID,
+			RedirectURI:   req.redirectURI,
+			Scopes:        req.scopes,
+			CodeChallenge: req.codeChallenge,
+			Expiry:        time.Now().Add(oauthCodeTTL),
+		}
+		err = app.models.OAuth.Authorize(code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		params.Set("code", code.Plaintext)
+	} else {
+		params.Set("error", "access_denied")
+	}
+	if req.state != "" {
+		params.Set("state", req.state)
+	}
+
+	// Redirect URIs were checked to be valid URLs when the client was registered.
+	redirect, err := url.Parse(req.redirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	query := redirect.Query()
+	for key := range params {
+		query.Set(key, params.Get(key))
+	}
+	redirect.RawQuery = query.Encode()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_uri": redirect.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The oauthTokenHandler() is the OAuth 2.0 token endpoint. Following RFC 6749 it reads
+// a form rather than JSON, and its responses don't use our usual envelope. Clients
+// authenticate with HTTP Basic authentication or client_id and client_secret form
+// fields, public clients sending only their client_id.
+//
+// The authorization_code grant exchanges a code for a token acting on behalf of the
+// user who approved it. The client_credentials grant is only open to confidential
+// clients, and gives a token acting on behalf of the user who registered the client.
+func (app *application) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body must be a valid form")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		// Credentials in the Authorization header are form-encoded first.
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := app.models.OAuth.GetClient(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "unknown client")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if client.Confidential && !client.MatchesSecret(clientSecret) || !client.Confidential && clientSecret != "" {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return
+	}
+
+	var userID int64
+	var scopes []string
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, err := app.models.OAuth.ExchangeCode(r.PostForm.Get("code"), client.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if r.PostForm.Get("redirect_uri") != code.RedirectURI {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match the authorization request")
+			return
+		}
+		verifier := r.PostForm.Get("code_verifier")
+		if !validator.Matches(verifier, data.CodeVerifierRX) || !code.VerifyChallenge(verifier) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match the code challenge")
+			return
+		}
+		userID, scopes = code.UserID, code.Scopes
+
+	case "client_credentials":
+		if !client.Confidential {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client_credentials grant")
+			return
+		}
+		scopes = strings.Fields(r.PostForm.Get("scope"))
+		if len(scopes) == 0 {
+			scopes = client.Scopes
+		}
+		for _, scope := range scopes {
+			if !slices.Contains(client.Scopes, scope) {
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "scope must only contain scopes registered by the client")
+				return
+			}
+		}
+		userID = client.UserID
+
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or client_credentials")
+		return
+	}
+
+	token, err := app.models.OAuth.NewToken(client.ID, userID, scopes, app.config.auth.accessTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(app.config.auth.accessTokenTTL.Seconds()),
+		"scope":        strings.Join(token.Scopes, " "),
+	}
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listOAuthGrantsHandler() lists the clients the user has given access to.
+func (app *application) listOAuthGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	grants, err := app.models.OAuth.GetConsentsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"grants": grants}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteOAuthGrantHandler() takes back the access the user gave a client, revoking
+// its tokens.
+func (app *application) deleteOAuthGrantHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := httprouter.ParamsFromContext(r.Context()).ByName("client_id")
+	user := app.contextGetUser(r)
+
+	err := app.models.OAuth.DeleteConsent(user.ID, clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "access successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tomasen/realip"
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/oidc"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// oidcLoginTTL is how long users have to log in at the identity provider.
+const oidcLoginTTL = 10 * time.Minute
+
+// The createOIDCAuthorizationHandler() starts a login through the OpenID Connect
+// provider. It responds with the provider URL to send the user to, which sends them
+// back to the configured redirect URL with a code and state for
+// createOIDCTokenHandler().
+func (app *application) createOIDCAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	login := &data.OIDCLogin{Expiry: time.Now().Add(oidcLoginTTL)}
+	for _, s := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		var err error
+		*s, err = oidc.RandomString()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	authorizationURL, err := app.oidc.AuthCodeURL(ctx, login.State, login.Nonce, oidc.CodeChallenge(login.CodeVerifier))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Identities.InsertLogin(login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authorization_url": authorizationURL}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createOIDCTokenHandler() finishes a login through the OpenID Connect provider.
+// It exchanges the code for an ID token, finds the user linked to the provider account
+// and logs them in with our usual tokens. Users logging in for the first time are
+// linked to the existing user with the same email address if the provider has verified
+// it, and otherwise get a new user.
+func (app *application) createOIDCTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code         string `json:"code"`
+		State        string `json:"state"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	login, err := app.models.Identities.TakeLogin(input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.errorResponse(w, r, http.StatusUnauthorized, "invalid or expired login state, please start again")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	idToken, err := app.oidc.Exchange(ctx, input.Code, login.CodeVerifier)
+	if err == nil {
+		var claims *oidc.Claims
+		claims, err = app.oidc.Verify(ctx, idToken, login.Nonce)
+		if err == nil {
+			app.oidcLogin(w, r, claims, input.TOTPCode, input.RecoveryCode)
+			return
+		}
+	}
+	switch {
+	case errors.Is(err, oidc.ErrExchange), errors.Is(err, oidc.ErrInvalidIDToken):
+		app.logger.Warn("oidc login failed", "error", err.Error())
+		app.errorResponse(w, r, http.StatusUnauthorized, "the identity provider login could not be verified")
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The oidcLogin() helper logs in the user linked to a verified provider account,
+// linking or provisioning one first if needed. The provider only stands in for the
+// password, so users who have enabled two-factor authentication must still send a
+// totp_code or recovery_code.
+func (app *application) oidcLogin(w http.ResponseWriter, r *http.Request, claims *oidc.Claims, totpCode, recoveryCode string) {
+	user, err := app.models.Identities.GetUser(claims.Issuer, claims.Subject)
+	link := false
+	if errors.Is(err, data.ErrRecordNotFound) {
+		user, link, err = app.oidcLinkUser(w, r, claims)
+		if user == nil && err == nil {
+			return
+		}
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user.IsBanned() {
+		app.bannedAccountResponse(w, r)
+		return
+	}
+	if !app.checkLoginSecondFactor(w, r, user, totpCode, recoveryCode) {
+		return
+	}
+
+	// Existing users are only linked to the provider account once they have passed
+	// the checks above.
+	if link {
+		err = app.models.Identities.Link(claims.Issuer, claims.Subject, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !user.Activated && !user.IsDeactivated() {
+			user.Activated = true
+			err = app.models.Users.Update(user)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	refreshToken, err := app.models.Tokens.NewRefresh(user.ID, app.config.auth.refreshTokenTTL, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.tokens.Issue(user, refreshToken.Family, app.config.auth.accessTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The oidcLinkUser() helper finds the user for a provider account seen for the first
+// time. It returns the existing user with the same email address along with true, in
+// which case the caller links the two, or provisions and links a new user. If it can't
+// do either, it sends the response itself and returns a nil user and error.
+func (app *application) oidcLinkUser(w http.ResponseWriter, r *http.Request, claims *oidc.Claims) (*data.User, bool, error) {
+	v := validator.New()
+	if data.ValidateEmail(v, claims.Email); !v.Valid() {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "the identity provider didn't share a valid email address")
+		return nil, false, nil
+	}
+
+	user, err := app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		// Only link to an existing user if the provider vouches for the email address,
+		// as otherwise anyone could take over an account by claiming its address.
+		if !claims.EmailVerified {
+			app.errorResponse(w, r, http.StatusConflict, "a user with this email address already exists, and the identity provider hasn't verified it")
+			return nil, false, nil
+		}
+		return user, true, nil
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, false, err
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+	user = &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: claims.EmailVerified,
+	}
+	// Provisioned users log in through the provider, so they get a random password,
+	// which they can replace through the password reset flow.
+	password := make([]byte, 32)
+	_, err = rand.Read(password)
+	if err != nil {
+		return nil, false, err
+	}
+	err = user.Password.Set(hex.EncodeToString(password))
+	if err != nil {
+		return nil, false, err
+	}
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false, nil
+	}
+
+	err = app.models.Identities.Provision(user, claims.Issuer, claims.Subject, data.RolePatron)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Users whose email address the provider hasn't verified activate their account in
+	// the usual way.
+	if !user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return nil, false, err
+		}
+		app.sendActivationEmail(user, token)
+	}
+	return user, false, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// The exportUserHandler() sends users a ZIP file with everything we hold about them,
+// with a JSON file for each kind of data.
+func (app *application) exportUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	loans, err := app.models.EbookLoans.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	reviews, err := app.models.Reviews.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	shelves, err := app.models.Shelves.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	shelfEntries, err := app.models.Shelves.GetEntriesForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	suggestions, err := app.models.Suggestions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r).family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	grants, err := app.models.OAuth.GetConsentsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	files := []struct {
+		name string
+		data envelope
+	}{
+		{"profile.json", envelope{"user": user, "roles": roles}},
+		{"loans.json", envelope{"ebook_loans": loans}},
+		{"reviews.json", envelope{"reviews": reviews}},
+		{"shelves.json", envelope{"shelves": shelves, "books": shelfEntries}},
+		{"suggestions.json", envelope{"suggestions": suggestions}},
+		{"sessions.json", envelope{"sessions": sessions}},
+		{"api-keys.json", envelope{"api_keys": apiKeys}},
+		{"oauth-grants.json", envelope{"grants": grants}},
+	}
+
+	// Build the whole archive before sending anything, so that we can still send an
+	// error response if something goes wrong.
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range files {
+		js, err := json.MarshalIndent(file.data, "", "\t")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		_, err = fw.Write(append(js, '\n'))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="maktaba-export.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// The deleteCurrentUserHandler() deletes the user's account once the grace period has
+// passed. Until then the account keeps working, so that the user can export their data
+// or cancel the deletion. When it is deleted, their ebook loans are kept without saying
+// who borrowed the book, and everything else about them is removed.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkCurrentPassword(w, r, user, "password", input.Password) {
+		return
+	}
+
+	// Asking again doesn't push the deletion back.
+	if user.DeleteAt == nil {
+		err = app.models.Users.ScheduleDeletion(user, time.Now().Add(app.config.accounts.deletionGrace))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{
+		"message": "your account will be deleted at delete_at, until then you can cancel the deletion",
+		"user":    user,
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The cancelUserDeletionHandler() keeps an account which was going to be deleted.
+func (app *application) cancelUserDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.DeleteAt == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err := app.models.Users.CancelDeletion(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -16,15 +16,133 @@ func (app *application) routes() http.Handler {
 	// passing in the required permission code as the first parameter.
 	router.HandlerFunc(http.MethodGet, "/v1/books", app.requirePermission("books:read", app.listBooksHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/books", app.requirePermission("books:write", app.createBookHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.requirePermission("books:read", app.showBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.matchParam("id", "duplicates",
+		app.requirePermission("books:write", app.listDuplicateBooksHandler),
+		app.requirePermission("books:read", app.showBookHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id", app.matchParam("id", "batch",
+		app.requirePermission("books:write", app.batchBooksHandler),
+		app.methodNotAllowedResponse))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/merge", app.requirePermission("books:write", app.mergeBookHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/books/:id", app.requirePermission("books:write", app.updateBookHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/books/:id", app.requirePermission("books:write", app.deleteBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/similar", app.requirePermission("books:read", app.similarBooksHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/reviews", app.requirePermission("books:read", app.listBookReviewsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/reviews", app.requireActivatedUser(app.createReviewHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/reviews/:id", app.requirePermission("reviews:moderate", app.moderateReviewHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/ebooks", app.requirePermission("books:read", app.listBookEbooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/ebooks", app.requirePermission("books:write", app.uploadEbookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/ebooks/:id", app.requirePermission("books:read", app.showEbookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/ebooks/:id", app.requirePermission("books:write", app.updateEbookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/ebooks/:id", app.requirePermission("books:write", app.deleteEbookHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/ebooks/:id/loans", app.requireActivatedUser(app.createEbookLoanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/downloads/:key", app.downloadHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/copies", app.requirePermission("books:read", app.listBookCopiesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/copies", app.requirePermission("copies:write", app.createBookCopyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/copies/:id", app.matchParam("id", "labels",
+		app.requirePermission("copies:write", app.printCopyLabelsHandler),
+		app.requirePermission("books:read", app.showCopyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/copies/:id/label", app.requirePermission("copies:write", app.showCopyLabelHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/copies/:id", app.requirePermission("copies:write", app.updateCopyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/copies/:id", app.requirePermission("copies:write", app.deleteCopyHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/copies/:id/transfers", app.requirePermission("copies:write", app.createTransferHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/transfers", app.requirePermission("copies:write", app.listTransfersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/transfers/:id", app.requirePermission("copies:write", app.showTransferHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/transfers/:id", app.requirePermission("copies:write", app.updateTransferHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/stocktakes", app.requirePermission("copies:write", app.listStocktakesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/stocktakes", app.requirePermission("copies:write", app.createStocktakeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/stocktakes/:id", app.requirePermission("copies:write", app.showStocktakeHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/stocktakes/:id/scans", app.requirePermission("copies:write", app.addStocktakeScansHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/stocktakes/:id/close", app.requirePermission("copies:write", app.closeStocktakeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/branches", app.requirePermission("books:read", app.listBranchesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/branches", app.requirePermission("branches:write", app.createBranchHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/branches/:id", app.requirePermission("books:read", app.showBranchHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/branches/:id", app.requirePermission("branches:write", app.updateBranchHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/branches/:id", app.requirePermission("branches:write", app.deleteBranchHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/suggestions", app.requirePermission("suggestions:manage", app.listSuggestionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/suggestions", app.requireActivatedUser(app.createSuggestionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/suggestions/:id", app.requirePermission("suggestions:manage", app.showSuggestionHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/suggestions/:id", app.requirePermission("suggestions:manage", app.updateSuggestionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.requirePermission("books:read", app.listGenresHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/genres", app.requirePermission("genres:write", app.createGenreHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/genres/:id", app.requirePermission("books:read", app.showGenreHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/genres/:id", app.requirePermission("genres:write", app.updateGenreHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/genres/:id/merge", app.requirePermission("genres:write", app.mergeGenreHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("roles:manage", app.listRolesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", app.requirePermission("roles:manage", app.listUserRolesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/roles/:role", app.requirePermission("roles:manage", app.grantUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("roles:manage", app.revokeUserRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/ban", app.requirePermission("users:admin", app.banUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/ban", app.requirePermission("users:admin", app.unbanUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/deactivate", app.requirePermission("users:admin", app.deactivateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/reactivate", app.requirePermission("users:admin", app.reactivateUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.showUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.updateUserPermissionsHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireActivatedUser(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/deletion", app.requireAuthenticatedUser(app.cancelUserDeletionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireAuthenticatedUser(app.exportUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireActivatedUser(app.changePasswordHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireActivatedUser(app.createEmailChangeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/ebook-loans", app.requireActivatedUser(app.listEbookLoansHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/ebook-loans/:id", app.requireActivatedUser(app.returnEbookLoanHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/ebook-loans/:id/link", app.requireActivatedUser(app.createEbookLinkHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.deleteAllSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.deleteSessionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireActivatedUser(app.createTOTPHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireActivatedUser(app.deleteTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp/confirm", app.requireActivatedUser(app.confirmTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp/recovery-codes", app.requireActivatedUser(app.createRecoveryCodesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireActivatedUser(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireActivatedUser(app.deleteAPIKeyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/oauth-grants", app.requireActivatedUser(app.listOAuthGrantsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/oauth-grants/:client_id", app.requireActivatedUser(app.deleteOAuthGrantHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/suggestions", app.requireActivatedUser(app.listUserSuggestionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/recommendations", app.requirePermission("books:read", app.userRecommendationsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/shelves", app.requireActivatedUser(app.listShelvesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/shelves/:shelf", app.requireActivatedUser(app.listShelfBooksHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/shelves/:shelf", app.requireActivatedUser(app.createShelfHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/shelves/:shelf", app.requireActivatedUser(app.deleteShelfHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/shelves/:shelf/books/:id", app.requireActivatedUser(app.addShelfBookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/shelves/:shelf/books/:id", app.requireActivatedUser(app.removeShelfBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireActivatedUser(app.listOAuthClientsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireActivatedUser(app.createOAuthClientHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/oauth/clients/:client_id", app.requireActivatedUser(app.deleteOAuthClientHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/authorize", app.requireActivatedUser(app.showAuthorizationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/authorize", app.requireActivatedUser(app.authorizeHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/token", app.oauthTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/oidc", app.createOIDCTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/oidc/authorization", app.createOIDCAuthorizationHandler)
 
 	// Register a new GET /debug/vars endpoint pointing to the expvar handler.
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
 	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
 }
+
+// The matchParam() helper works around httprouter not allowing a static path segment
+// and a named parameter in the same position of a route, such as /v1/books/duplicates
+// next to /v1/books/:id. Requests where the named parameter equals value are passed
+// to match, and all other requests to next.
+func (app *application) matchParam(name, value string, match, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName(name) == value {
+			match(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -25,6 +25,12 @@ func (app *application) serve() error {
 
 	shutdownError := make(chan error)
 
+	// Start the periodic background jobs. They are stopped by cancelling jobsCtx when
+	// the server begins shutting down.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	app.startJobs(jobsCtx)
+
 	// Start a background goroutine.
 	go func() {
 		// Create a quit channel which carries os.Signal values.
@@ -42,6 +48,9 @@ func (app *application) serve() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
+		// Stop scheduling new background jobs.
+		stopJobs()
+
 		// Call Shutdown() on the server like before, but now we only send on the
 		// shutdownError channel if it returns an error.
 		err := srv.Shutdown(ctx)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+)
+
+// The listSessionsHandler() lists the user's active logins, so that they can spot
+// sessions they don't recognize.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r).family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	family, err := app.models.Tokens.DeleteSessionForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.tokens.RevokeFamily(family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAllSessionsHandler() revokes every session of the user, including the one
+// used to make the request.
+func (app *application) deleteAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all sessions successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revokeSession() helper revokes every token of a login: the refresh tokens in the
+// database and the authentication tokens, wherever the token backend keeps them.
+func (app *application) revokeSession(family string) error {
+	err := app.models.Tokens.DeleteFamily(family)
+	if err != nil {
+		return err
+	}
+	return app.tokens.RevokeFamily(family)
+}
+
+// The revokeAllSessions() helper signs a user out everywhere.
+func (app *application) revokeAllSessions(userID int64) error {
+	err := app.models.Tokens.DeleteAllForUser(data.ScopeRefresh, userID)
+	if err != nil {
+		return err
+	}
+	return app.tokens.RevokeUser(userID)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+func (app *application) listShelvesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	shelves, err := app.models.Shelves.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"shelves": shelves}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createShelfHandler() creates a custom shelf named after the URL parameter. As
+// PUT is idempotent, asking for a shelf which already exists isn't an error.
+func (app *application) createShelfHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	shelf := &data.Shelf{Name: app.readShelfParam(r)}
+
+	v := validator.New()
+	data.ValidateShelfName(v, shelf.Name)
+	v.Check(!data.IsBuiltinShelf(shelf.Name), "shelf", "is a built-in shelf")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	status := http.StatusCreated
+	err := app.models.Shelves.Insert(user.ID, shelf)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateShelf):
+			status = http.StatusOK
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, status, envelope{"shelf": shelf}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteShelfHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	name := app.readShelfParam(r)
+
+	v := validator.New()
+	if v.Check(!data.IsBuiltinShelf(name), "shelf", "built-in shelves cannot be deleted"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Shelves.Delete(user.ID, name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "shelf successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listShelfBooksHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	name := app.readShelfParam(r)
+
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-added_at")
+	input.Filters.SortSafelist = []string{"added_at", "title", "year", "rating", "-added_at", "-title", "-year", "-rating"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	books, metadata, err := app.models.Shelves.GetBooks(user.ID, name, input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.attachShelves(r, books...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"books": books, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addShelfBookHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	name := app.readShelfParam(r)
+
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Shelves.AddBook(user.ID, name, bookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "book successfully added to shelf"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeShelfBookHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	name := app.readShelfParam(r)
+
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Shelves.RemoveBook(user.ID, name, bookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "book successfully removed from shelf"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The attachShelves() helper fills in the Shelves field of each book with the
+// shelves of the authenticated user that the book is on. Anonymous requests are left
+// untouched.
+func (app *application) attachShelves(r *http.Request, books ...*data.Book) error {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() || len(books) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+
+	shelves, err := app.models.Shelves.GetForBooks(user.ID, ids)
+	if err != nil {
+		return err
+	}
+	for _, book := range books {
+		book.Shelves = shelves[book.ID]
+	}
+	return nil
+}
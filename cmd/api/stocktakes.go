@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+func (app *application) listStocktakesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	branchID, err := app.readBranchFilter(qs, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	input.Status = app.readString(qs, "status", "")
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "-id"}
+
+	if input.Status != "" {
+		v.Check(validator.PermittedValue(input.Status, data.StocktakeOpen, data.StocktakeClosed), "status", "invalid status value")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	stocktakes, metadata, err := app.models.Stocktakes.GetAll(branchID, input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"stocktakes": stocktakes, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createStocktakeHandler() opens a stocktake session for a branch. If a location is
+// given, the session only covers the copies shelved at that location.
+func (app *application) createStocktakeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		BranchID int64  `json:"branch_id"`
+		Location string `json:"location"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	stocktake := &data.Stocktake{
+		BranchID:  input.BranchID,
+		Location:  input.Location,
+		StartedBy: &user.ID,
+	}
+
+	v := validator.New()
+	if data.ValidateStocktake(v, stocktake); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Stocktakes.Insert(stocktake)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnknownBranch):
+			v.AddError("branch_id", "must reference an existing branch")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrOpenStocktake):
+			app.errorResponse(w, r, http.StatusConflict, "a stocktake is already open for this branch and location")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/stocktakes/%d", stocktake.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"stocktake": stocktake}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showStocktakeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	stocktake, err := app.models.Stocktakes.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"stocktake": stocktake}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The addStocktakeScansHandler() records a batch of scanned barcodes. Scanners can
+// send barcodes one at a time or in bulk, and re-sending a barcode is harmless.
+func (app *application) addStocktakeScansHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Barcodes []string `json:"barcodes"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateBarcodes(v, input.Barcodes); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	stocktake := &data.Stocktake{ID: id}
+	added, err := app.models.Stocktakes.AddScans(stocktake, input.Barcodes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrStocktakeClosed):
+			app.errorResponse(w, r, http.StatusConflict, "the stocktake has been closed")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"added": added, "scan_count": stocktake.ScanCount}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The closeStocktakeHandler() closes a stocktake and responds with its report. Sending
+// "mark_missing": true also gives the copies which weren't found the missing status.
+func (app *application) closeStocktakeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		MarkMissing bool `json:"mark_missing"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	stocktake, err := app.models.Stocktakes.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Stocktakes.Close(stocktake, input.MarkMissing)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrStocktakeClosed):
+			app.errorResponse(w, r, http.StatusConflict, "the stocktake has already been closed")
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"stocktake": stocktake}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
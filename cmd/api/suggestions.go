@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// The createSuggestionHandler() lets an activated user ask the library to buy a book.
+func (app *application) createSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title  string `json:"title"`
+		Author string `json:"author"`
+		ISBN   string `json:"isbn"`
+		Year   int32  `json:"year"`
+		Note   string `json:"note"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	suggestion := &data.Suggestion{
+		UserID: user.ID,
+		Title:  input.Title,
+		Author: input.Author,
+		ISBN:   data.NormalizeISBN(input.ISBN),
+		Year:   input.Year,
+		Note:   input.Note,
+	}
+
+	v := validator.New()
+	if data.ValidateSuggestion(v, suggestion); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Suggestions.Insert(suggestion)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/suggestions/%d", suggestion.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"suggestion": suggestion}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listSuggestionsHandler() lists every user's suggestions for librarians, who can
+// filter them by status.
+func (app *application) listSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listSuggestions(w, r, 0)
+}
+
+// The listUserSuggestionsHandler() lists the suggestions made by the authenticated
+// user.
+func (app *application) listUserSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listSuggestions(w, r, app.contextGetUser(r).ID)
+}
+
+func (app *application) listSuggestions(w http.ResponseWriter, r *http.Request, userID int64) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "title", "-id", "-title"}
+
+	if input.Status != "" {
+		v.Check(validator.PermittedValue(input.Status, data.SuggestionStatuses...), "status", "invalid status value")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, metadata, err := app.models.Suggestions.GetAll(userID, input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	suggestion, err := app.models.Suggestions.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestion": suggestion}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateSuggestionHandler() moves a suggestion through the approval workflow and
+// lets librarians leave a note for the patron, who is emailed about every status
+// change. Marking a suggestion as received adds the book to the catalogue, using the
+// suggested title, year and ISBN unless they are overridden in "book". As the catalogue
+// requires them, "book" must include at least the genres and page count.
+func (app *application) updateSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	suggestion, err := app.models.Suggestions.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Status        *string    `json:"status"`
+		LibrarianNote *string    `json:"librarian_note"`
+		Book          *bookInput `json:"book"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	statusChanged := input.Status != nil && *input.Status != suggestion.Status
+	if statusChanged {
+		v.Check(validator.PermittedValue(*input.Status, data.SuggestionStatuses...), "status", "invalid status value")
+		if v.Valid() {
+			v.Check(data.ValidSuggestionTransition(suggestion.Status, *input.Status), "status",
+				fmt.Sprintf("cannot change from %s to %s", suggestion.Status, *input.Status))
+		}
+		suggestion.Status = *input.Status
+	}
+	if input.LibrarianNote != nil {
+		suggestion.LibrarianNote = *input.LibrarianNote
+	}
+	v.Check(input.Book == nil || (statusChanged && suggestion.Status == data.SuggestionReceived), "book",
+		"must only be provided when marking the suggestion as received")
+	if data.ValidateSuggestion(v, suggestion); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Build the catalogue entry for a received suggestion. Its validation errors are
+	// reported under "book." so that they can't be confused with the suggestion's.
+	var book *data.Book
+	if statusChanged && suggestion.Status == data.SuggestionReceived {
+		book = &data.Book{
+			Title: suggestion.Title,
+			Year:  suggestion.Year,
+			ISBN:  suggestion.ISBN,
+		}
+		if input.Book != nil {
+			input.Book.apply(book)
+		}
+
+		bv := validator.New()
+		if data.ValidateBook(bv, book); !bv.Valid() {
+			for key, message := range bv.Errors {
+				v.AddError("book."+key, message)
+			}
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Suggestions.Update(suggestion, book)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrUnknownGenre):
+			v.AddError("book.genres", "must only contain known genres")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if statusChanged {
+		app.background(func() {
+			user, err := app.models.Users.Get(suggestion.UserID)
+			if err != nil {
+				app.logger.Error(err.Error())
+				return
+			}
+
+			data := map[string]any{
+				"name":   user.Name,
+				"title":  suggestion.Title,
+				"status": suggestion.Status,
+				"note":   suggestion.LibrarianNote,
+			}
+			if suggestion.BookID != nil {
+				data["bookID"] = *suggestion.BookID
+			}
+			err = app.mailer.Send(user.Email, "suggestion_status.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestion": suggestion}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -4,17 +4,22 @@ import (
 	"errors"
 
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/tomasen/realip"
 	"github.com/xarafeddine/maktaba/internal/data"
 	"github.com/xarafeddine/maktaba/internal/validator"
 )
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse the email and password from the request body.
+	// Parse the email and password from the request body, along with the second
+	// factor for users who have enabled two-factor authentication.
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -54,16 +59,239 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Banned users can't log in. We only tell them once they've proved who they are.
+	if user.IsBanned() {
+		app.bannedAccountResponse(w, r)
+		return
+	}
+	// Users who have enabled two-factor authentication must also send a code from
+	// their authenticator app or one of their recovery codes.
+	if !app.checkLoginSecondFactor(w, r, user, input.TOTPCode, input.RecoveryCode) {
+		return
+	}
+	// Otherwise, if the credentials are correct, we start a session with a refresh token,
+	// which records the client it was issued to and can be exchanged for new tokens,
+	// and issue an authentication token in the same family.
+	refreshToken, err := app.models.Tokens.NewRefresh(user.ID, app.config.auth.refreshTokenTTL, r.UserAgent(), realip.FromRequest(r))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Encode the token to JSON and send it in the response along with a 201 Created
+	token, err := app.tokens.Issue(user, refreshToken.Family, app.config.auth.accessTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Encode the tokens to JSON and send them in the response along with a 201 Created
 	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The refreshTokenHandler() exchanges a refresh token for a new authentication token
+// and refresh token. Each refresh token can only be used once; presenting one again
+// revokes every token descended from the same login, as it has probably been stolen.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	refreshToken, err := app.models.Tokens.Rotate(input.RefreshToken, app.config.auth.refreshTokenTTL, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.errorResponse(w, r, http.StatusUnauthorized, "invalid or expired refresh token")
+		case errors.Is(err, data.ErrTokenReused):
+			// The database tokens of the family are already gone, but stateless
+			// authentication tokens must be revoked by the token backend.
+			err = app.tokens.RevokeFamily(refreshToken.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.errorResponse(w, r, http.StatusUnauthorized, "refresh token has already been used, please log in again")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Issue the authentication token with up-to-date user details, as stateless tokens
+	// carry them. Banning a user revokes their refresh tokens, but a refresh racing the
+	// ban mustn't hand out a new authentication token.
+	user, err := app.models.Users.Get(refreshToken.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.IsBanned() {
+		app.bannedAccountResponse(w, r)
+		return
+	}
+	token, err := app.tokens.Issue(user, refreshToken.Family, app.config.auth.accessTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createPasswordResetTokenHandler() emails a password reset token to the owner of
+// an activated account. The response is the same whether or not the email address
+// belongs to an account, so that it can't be used to find out who has one.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an activated account exists for this email address, you will receive password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]any{
+				"passwordResetToken": token.Plaintext,
+			}
+			err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createActivationTokenHandler() sends a new activation token to a user who didn't
+// activate their account before the first one expired. Like password resets, the
+// response doesn't reveal whether the email address belongs to an account. Repeat
+// requests for the same address are rate limited, whether or not it has an account.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if app.config.limiter.enabled && !app.activationLimiter.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	env := envelope{"message": "if an unactivated account exists for this email address, you will receive activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Users deactivated by an admin don't get a token, as they couldn't use it.
+	if !user.Activated && !user.IsDeactivated() {
+		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.sendActivationEmail(user, token)
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAuthenticationTokenHandler() logs out by revoking the token used to make
+// the request, along with the rest of its session.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.contextGetToken(r)
+
+	// Tokens issued before sessions had families can only be revoked one by one.
+	err := app.models.Tokens.Delete(data.ScopeAuthentication, token.plaintext)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.revokeSession(token.family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/totp"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// The createTOTPHandler() starts enrolling the user in two-factor authentication. It
+// responds with the secret, and an otpauth:// URI which can be shown as a QR code for
+// authenticator apps to scan. Enrollment takes effect once a code has been confirmed.
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Begin(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret": secret,
+		"uri":    totp.URI("Maktaba", user.Email, secret),
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The confirmTOTPHandler() turns two-factor authentication on once the user has sent a
+// code from their authenticator app, and responds with their recovery codes. This is
+// the only time the recovery codes are shown.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	credential, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication enrollment hasn't been started")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if credential.Confirmed {
+		app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := totp.Validate(credential.Secret, input.Code, time.Now())
+	if v.Check(ok, "code", "is incorrect"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, hashes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Confirm(user.ID, step, hashes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteTOTPHandler() turns two-factor authentication off, after checking a code or
+// recovery code. Users who hold a permission which requires two-factor authentication
+// can't turn it off.
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, code := range permissions {
+		if slices.Contains(app.config.auth.twoFactorPermissions, code) {
+			app.errorResponse(w, r, http.StatusForbidden, "two-factor authentication is required for your user account")
+			return
+		}
+	}
+
+	if !app.requireSecondFactor(w, r) {
+		return
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createRecoveryCodesHandler() replaces the user's recovery codes, after checking a
+// code or recovery code.
+func (app *application) createRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.requireSecondFactor(w, r) {
+		return
+	}
+
+	codes, hashes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.TOTP.ReplaceRecoveryCodes(user.ID, hashes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The requireSecondFactor() helper reads a "code" or "recovery_code" from the request
+// body and checks it against the user's confirmed enrollment. If anything is wrong it
+// sends the response itself and returns false.
+func (app *application) requireSecondFactor(w http.ResponseWriter, r *http.Request) bool {
+	var input struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return false
+	}
+
+	v := validator.New()
+	if v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	user := app.contextGetUser(r)
+	credential, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if credential == nil || !credential.Confirmed {
+		app.errorResponse(w, r, http.StatusConflict, "two-factor authentication isn't enabled")
+		return false
+	}
+
+	if !app.allowTwoFactorAttempt(w, r, user.ID) {
+		return false
+	}
+	ok, err := app.checkTwoFactor(credential, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if v.Check(ok, "code", "is incorrect"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	return true
+}
+
+// The checkLoginSecondFactor() helper checks the second factor of a user logging in,
+// for users who have enabled two-factor authentication. Every way of logging in must
+// call it before issuing tokens. If the check fails it sends the response itself and
+// returns false.
+func (app *application) checkLoginSecondFactor(w http.ResponseWriter, r *http.Request, user *data.User, code, recoveryCode string) bool {
+	credential, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if credential == nil || !credential.Confirmed {
+		return true
+	}
+	if code == "" && recoveryCode == "" {
+		app.twoFactorRequiredResponse(w, r)
+		return false
+	}
+	if !app.allowTwoFactorAttempt(w, r, user.ID) {
+		return false
+	}
+	match, err := app.checkTwoFactor(credential, code, recoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// The allowTwoFactorAttempt() helper limits how often a user's second factor can be
+// tried, wherever the attempts come from, as the per-IP limit alone would let anyone
+// who has the password spread their guesses over many addresses. If the user has
+// tried too often it sends the response itself and returns false.
+func (app *application) allowTwoFactorAttempt(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	if app.config.limiter.enabled && !app.twoFactorLimiter.Allow(strconv.FormatInt(userID, 10)) {
+		app.rateLimitExceededResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// The checkTwoFactor() helper checks a code from an authenticator app, or failing that
+// a recovery code. Both can only be used once.
+func (app *application) checkTwoFactor(credential *data.TOTPCredential, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := totp.Validate(credential.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return app.models.TOTP.UseStep(credential.UserID, step)
+	}
+	if recoveryCode != "" {
+		return app.models.TOTP.UseRecoveryCode(credential.UserID, recoveryCode)
+	}
+	return false, nil
+}
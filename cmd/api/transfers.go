@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+func (app *application) listTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	branchID, err := app.readBranchFilter(qs, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	input.Status = app.readString(qs, "status", "")
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "-id"}
+
+	if input.Status != "" {
+		v.Check(validator.PermittedValue(input.Status, data.TransferStatuses...), "status", "invalid status value")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	transfers, metadata, err := app.models.Transfers.GetAll(branchID, input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"transfers": transfers, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createTransferHandler() requests that the copy in the URL is sent from the branch
+// it is currently at to the branch given in the request body.
+func (app *application) createTransferHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		ToBranchID int64 `json:"to_branch_id"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.ToBranchID > 0, "to_branch_id", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	transfer := &data.Transfer{
+		CopyID:      id,
+		ToBranchID:  input.ToBranchID,
+		RequestedBy: &user.ID,
+	}
+
+	err = app.models.Transfers.Insert(transfer)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrUnknownBranch):
+			v.AddError("to_branch_id", "must reference an existing branch")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrSameBranch):
+			v.AddError("to_branch_id", "must be a different branch from the one the copy is at")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrOpenTransfer):
+			app.errorResponse(w, r, http.StatusConflict, "the copy already has an open transfer")
+		case errors.Is(err, data.ErrCopyUnavailable):
+			app.errorResponse(w, r, http.StatusConflict, "the copy isn't available to transfer")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/transfers/%d", transfer.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"transfer": transfer}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showTransferHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	transfer, err := app.models.Transfers.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"transfer": transfer}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateTransferHandler() moves a transfer along: "in_transit" when the copy has
+// been shipped, "received" when it arrives, or "cancelled" before it is shipped.
+func (app *application) updateTransferHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	transfer, err := app.models.Transfers.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Status string `json:"status"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Status != "", "status", "must be provided")
+	v.Check(validator.PermittedValue(input.Status, data.TransferStatuses...), "status", "invalid status value")
+	if v.Valid() {
+		v.Check(data.ValidTransferTransition(transfer.Status, input.Status), "status",
+			fmt.Sprintf("cannot change from %s to %s", transfer.Status, input.Status))
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Transfers.Transition(transfer, input.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrCopyUnavailable):
+			app.errorResponse(w, r, http.StatusConflict, "the copy isn't available to ship, cancel the transfer instead")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"transfer": transfer}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,33 @@
+// Package auth issues and checks the access tokens that clients send in the
+// Authorization header. Tokens can either be kept in the database, which makes every
+// authenticated request look its token up, or be signed and stateless, which lets
+// requests be authenticated without touching the database.
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+)
+
+var ErrInvalidToken = errors.New("auth: invalid or expired token")
+
+// Identity is who an access token was issued to. Family identifies the login the token
+// belongs to, and is empty for tokens issued before logins had families.
+type Identity struct {
+	User   *data.User
+	Family string
+}
+
+// Issuer issues, checks and revokes access tokens.
+type Issuer interface {
+	// Issue creates an access token for user in a login family.
+	Issue(user *data.User, family string, ttl time.Duration) (*data.Token, error)
+	// Authenticate returns the identity of a token, or ErrInvalidToken.
+	Authenticate(token string) (*Identity, error)
+	// RevokeFamily revokes the access tokens of a login.
+	RevokeFamily(family string) error
+	// RevokeUser revokes every access token of a user issued so far.
+	RevokeUser(userID int64) error
+}
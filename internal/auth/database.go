@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// DatabaseIssuer keeps access tokens in the tokens table. Tokens are looked up on every
+// request, so revocations take effect immediately.
+type DatabaseIssuer struct {
+	Models data.Models
+}
+
+func (i DatabaseIssuer) Issue(user *data.User, family string, ttl time.Duration) (*data.Token, error) {
+	return i.Models.Tokens.NewAuthentication(user.ID, family, ttl)
+}
+
+func (i DatabaseIssuer) Authenticate(token string) (*Identity, error) {
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, ErrInvalidToken
+	}
+
+	user, family, err := i.Models.Users.GetForAuthenticationToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, ErrInvalidToken
+		default:
+			return nil, err
+		}
+	}
+	return &Identity{User: user, Family: family}, nil
+}
+
+func (i DatabaseIssuer) RevokeFamily(family string) error {
+	return i.Models.Tokens.DeleteFamily(family)
+}
+
+func (i DatabaseIssuer) RevokeUser(userID int64) error {
+	return i.Models.Tokens.DeleteAllForUser(data.ScopeAuthentication, userID)
+}
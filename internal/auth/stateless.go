@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/data"
+	"github.com/xarafeddine/maktaba/internal/paseto"
+)
+
+// Key is an Ed25519 signing key and the ID that tokens signed with it carry.
+type Key struct {
+	ID      string
+	Private ed25519.PrivateKey
+}
+
+// ParseKeys parses a space-separated list of keys in the form "id:seed", where seed is
+// the base64-encoded 32-byte Ed25519 seed. The first key signs new tokens; the others
+// are only used to verify tokens signed before the keys were rotated.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, field := range strings.Fields(s) {
+		id, encodedSeed, ok := strings.Cut(field, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("auth: key %q must be in the form id:seed", field)
+		}
+		seed, err := base64.StdEncoding.DecodeString(encodedSeed)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("auth: seed of key %q must be %d base64-encoded bytes", id, ed25519.SeedSize)
+		}
+		keys = append(keys, Key{ID: id, Private: ed25519.NewKeyFromSeed(seed)})
+	}
+	return keys, nil
+}
+
+// GenerateKey returns a random key.
+func GenerateKey(id string) (Key, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{ID: id, Private: private}, nil
+}
+
+// claims is the message of a stateless token. It carries the user details needed to
+// authenticate a request, so they may be out of date until the token expires. The
+// activated claim is only informational, as the issuer looks the status up instead.
+type claims struct {
+	ID        string    `json:"jti"`
+	Subject   string    `json:"sub"`
+	IssuedAt  time.Time `json:"iat"`
+	Expiry    time.Time `json:"exp"`
+	Family    string    `json:"fam,omitempty"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Activated bool      `json:"activated"`
+}
+
+type footer struct {
+	KeyID string `json:"kid"`
+}
+
+// StatelessIssuer issues PASETO v4.public tokens signed with Ed25519, which are checked
+// without looking the token up. Revoked logins and users are kept on an in-memory
+// denylist until every token they could hold has expired. The denylist isn't shared,
+// so when running several instances of the API revocations only take effect on the
+// instance that handled them, and elsewhere once the tokens expire.
+//
+// Whether the user is activated or banned is too important to wait for that, so it is
+// looked up in the database and cached for statusTTL. Bans and deactivations thus take
+// effect everywhere within statusTTL, and immediately on the instance handling them.
+type StatelessIssuer struct {
+	key       Key
+	public    map[string]ed25519.PublicKey
+	maxTTL    time.Duration
+	users     data.UserModel
+	statusTTL time.Duration
+
+	mu          sync.Mutex
+	families    map[string]time.Time
+	revocations map[int64]userRevocation
+	statuses    map[int64]cachedStatus
+	nextSweep   time.Time
+}
+
+type userRevocation struct {
+	before time.Time
+	until  time.Time
+}
+
+type cachedStatus struct {
+	status *data.UserStatus
+	until  time.Time
+}
+
+// NewStatelessIssuer returns an issuer which signs tokens with the first key and
+// accepts tokens signed by any of them. maxTTL is the longest lifetime of the tokens
+// it issues, and decides how long revocations are remembered. The status of users is
+// looked up with users and cached for statusTTL, or not cached if it is zero.
+func NewStatelessIssuer(keys []Key, maxTTL time.Duration, users data.UserModel, statusTTL time.Duration) (*StatelessIssuer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("auth: at least one key is required")
+	}
+
+	public := make(map[string]ed25519.PublicKey, len(keys))
+	for _, key := range keys {
+		if _, exists := public[key.ID]; exists {
+			return nil, fmt.Errorf("auth: duplicate key ID %q", key.ID)
+		}
+		public[key.ID] = key.Private.Public().(ed25519.PublicKey)
+	}
+
+	return &StatelessIssuer{
+		key:         keys[0],
+		public:      public,
+		maxTTL:      maxTTL,
+		users:       users,
+		statusTTL:   statusTTL,
+		families:    make(map[string]time.Time),
+		revocations: make(map[int64]userRevocation),
+		statuses:    make(map[int64]cachedStatus),
+	}, nil
+}
+
+func (i *StatelessIssuer) Issue(user *data.User, family string, ttl time.Duration) (*data.Token, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	message, err := json.Marshal(claims{
+		ID:        hex.EncodeToString(id),
+		Subject:   strconv.FormatInt(user.ID, 10),
+		IssuedAt:  now,
+		Expiry:    now.Add(ttl),
+		Family:    family,
+		Name:      user.Name,
+		Email:     user.Email,
+		Activated: user.Activated,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encodedFooter, err := json.Marshal(footer{KeyID: i.key.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	// A new token usually follows a change to the user, such as being unbanned, so look
+	// their status up again.
+	i.mu.Lock()
+	delete(i.statuses, user.ID)
+	i.mu.Unlock()
+
+	return &data.Token{
+		Plaintext: paseto.Sign(i.key.Private, message, encodedFooter),
+		UserID:    user.ID,
+		Expiry:    now.Add(ttl),
+		Scope:     data.ScopeAuthentication,
+		Family:    family,
+	}, nil
+}
+
+func (i *StatelessIssuer) Authenticate(token string) (*Identity, error) {
+	rawFooter, err := paseto.Footer(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var f footer
+	err = json.Unmarshal(rawFooter, &f)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, ok := i.public[f.KeyID]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	message, err := paseto.Verify(key, token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var c claims
+	err = json.Unmarshal(message, &c)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	userID, err := strconv.ParseInt(c.Subject, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if !now.Before(c.Expiry) || i.revoked(userID, c.Family, c.IssuedAt, now) {
+		return nil, ErrInvalidToken
+	}
+
+	status, err := i.status(userID, now)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, ErrInvalidToken
+		default:
+			return nil, err
+		}
+	}
+
+	user := &data.User{
+		ID:        userID,
+		Name:      c.Name,
+		Email:     c.Email,
+		Activated: status.Activated,
+		BannedAt:  status.BannedAt,
+	}
+	return &Identity{User: user, Family: c.Family}, nil
+}
+
+func (i *StatelessIssuer) RevokeFamily(family string) error {
+	if family == "" {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.sweep()
+	i.families[family] = time.Now().Add(i.maxTTL)
+	return nil
+}
+
+func (i *StatelessIssuer) RevokeUser(userID int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.sweep()
+	now := time.Now()
+	i.revocations[userID] = userRevocation{before: now, until: now.Add(i.maxTTL)}
+	// Users are revoked when they are banned or deactivated, so look them up again.
+	delete(i.statuses, userID)
+	return nil
+}
+
+// status returns whether a user is activated and banned, from the cache if it is
+// recent enough.
+func (i *StatelessIssuer) status(userID int64, now time.Time) (*data.UserStatus, error) {
+	i.mu.Lock()
+	cached, ok := i.statuses[userID]
+	i.mu.Unlock()
+	if ok && now.Before(cached.until) {
+		return cached.status, nil
+	}
+
+	status, err := i.users.GetStatus(userID)
+	if err != nil {
+		return nil, err
+	}
+	i.cacheStatus(userID, status, now)
+	return status, nil
+}
+
+func (i *StatelessIssuer) cacheStatus(userID int64, status *data.UserStatus, now time.Time) {
+	if i.statusTTL <= 0 {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if now.After(i.nextSweep) {
+		i.sweep()
+		i.nextSweep = now.Add(i.statusTTL)
+	}
+	i.statuses[userID] = cachedStatus{status: status, until: now.Add(i.statusTTL)}
+}
+
+// revoked reports whether a token issued at issuedAt has been revoked, either along
+// with its login or with every token of its user issued until then.
+func (i *StatelessIssuer) revoked(userID int64, family string, issuedAt, now time.Time) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if until, ok := i.families[family]; ok && now.Before(until) {
+		return true
+	}
+	if revocation, ok := i.revocations[userID]; ok && now.Before(revocation.until) && !issuedAt.After(revocation.before) {
+		return true
+	}
+	return false
+}
+
+// sweep forgets the revocations which no longer matter, as every token they applied to
+// has expired, and the statuses which are too old to use. It must be called with the
+// mutex held.
+func (i *StatelessIssuer) sweep() {
+	now := time.Now()
+	for family, until := range i.families {
+		if !now.Before(until) {
+			delete(i.families, family)
+		}
+	}
+	for userID, revocation := range i.revocations {
+		if !now.Before(revocation.until) {
+			delete(i.revocations, userID)
+		}
+	}
+	for userID, cached := range i.statuses {
+		if !now.Before(cached.until) {
+			delete(i.statuses, userID)
+		}
+	}
+}
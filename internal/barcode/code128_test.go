@@ -0,0 +1,210 @@
+package barcode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/color"
+	"image/png"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// symbols decodes the modules of a barcode back into symbol values, by reading the
+// widths of each run of bars and spaces.
+func symbols(t *testing.T, b *Barcode) []int {
+	t.Helper()
+
+	var widths []byte
+	for i := 0; i < len(b.modules); {
+		j := i
+		for j < len(b.modules) && b.modules[j] == b.modules[i] {
+			j++
+		}
+		widths = append(widths, byte('0'+j-i))
+		i = j
+	}
+
+	var values []int
+	for len(widths) > 0 {
+		// Every symbol has six runs, except the stop symbol, which has seven.
+		n := 6
+		if len(widths) == 7 {
+			n = 7
+		}
+		if len(widths) < n {
+			t.Fatalf("%d runs left over after symbols %v", len(widths), values)
+		}
+		value := slices.Index(patterns[:], string(widths[:n]))
+		if value < 0 {
+			t.Fatalf("unknown pattern %s after symbols %v", widths[:n], values)
+		}
+		values = append(values, value)
+		widths = widths[n:]
+	}
+	return values
+}
+
+func TestPatterns(t *testing.T) {
+	// Code 128 symbols are 11 modules wide, with an even number of bar modules, and the
+	// stop symbol adds a two module bar.
+	for value, pattern := range patterns {
+		width, bars := 0, 0
+		for i, w := range pattern {
+			width += int(w - '0')
+			if i%2 == 0 {
+				bars += int(w - '0')
+			}
+		}
+		wantWidth, wantRuns := 11, 6
+		if value == stop {
+			wantWidth, wantRuns = 13, 7
+		}
+		if width != wantWidth || len(pattern) != wantRuns || bars%2 != 0 {
+			t.Errorf("symbol %d: pattern %s is malformed", value, pattern)
+		}
+	}
+	if len(slices.Compact(slices.Sorted(slices.Values(patterns[:])))) != len(patterns) {
+		t.Error("patterns aren't unique")
+	}
+
+	for value, want := range map[int]string{0: "212222", startB: "211214", startC: "211232", stop: "2331112"} {
+		if patterns[value] != want {
+			t.Errorf("symbol %d: got pattern %s, want %s", value, patterns[value], want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		values []int
+	}{
+		// The check symbols are worked out by hand: the start value plus each data
+		// value times its position, modulo 103.
+		{"code set B", "PJJ123C", []int{startB, 48, 42, 42, 17, 18, 19, 35, 55, stop}},
+		{"code set C", "1234", []int{startC, 12, 34, 82, stop}},
+		{"odd number of digits", "123", []int{startB, 17, 18, 19, 8, stop}},
+		{"single character", "A", []int{startB, 33, 34, stop}},
+		{"checksum wraps", "~~", []int{startB, 94, 94, 77, stop}},
+		{"leading zeros", "0007", []int{startC, 0, 7, 16, stop}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := Encode(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := symbols(t, b); !slices.Equal(got, tt.values) {
+				t.Errorf("got symbols %v, want %v", got, tt.values)
+			}
+
+			// Each symbol is 11 modules wide, and the stop symbol 13.
+			wantWidth := 11*(len(tt.values)-1) + 13 + 2*QuietZone
+			if b.Width() != wantWidth {
+				t.Errorf("got width %d, want %d", b.Width(), wantWidth)
+			}
+			if !b.modules[0] || !b.modules[len(b.modules)-1] {
+				t.Error("barcode doesn't start and end with a bar")
+			}
+		})
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"too long", strings.Repeat("a", 81)},
+		{"control character", "a\tb"},
+		{"non-ASCII", "café"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Encode(tt.data)
+			if !errors.Is(err, ErrInvalidData) {
+				t.Errorf("got error %v, want ErrInvalidData", err)
+			}
+		})
+	}
+}
+
+func TestSVG(t *testing.T) {
+	b, err := Encode("<A&B>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = b.SVG(&buf, Options{ModuleWidth: 2, Height: 50, ShowText: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := buf.String()
+
+	bars := 0
+	for i, module := range b.modules {
+		if module && (i == 0 || !b.modules[i-1]) {
+			bars++
+		}
+	}
+	// One rectangle for the background, and one for each run of bars.
+	if got := strings.Count(svg, "<rect"); got != bars+1 {
+		t.Errorf("got %d rectangles, want %d", got, bars+1)
+	}
+	width := b.Width() * 2
+	if !strings.Contains(svg, fmt.Sprintf(`width="%d" height="70"`, width)) {
+		t.Errorf("SVG doesn't have width %d and height 70: %s", width, svg[:100])
+	}
+	if !strings.Contains(svg, ">&lt;A&amp;B&gt;</text>") {
+		t.Error("SVG doesn't contain the escaped text")
+	}
+
+	buf.Reset()
+	err = b.SVG(&buf, Options{ModuleWidth: 2, Height: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "<text") {
+		t.Error("SVG contains text although ShowText is false")
+	}
+}
+
+func TestPNG(t *testing.T) {
+	b, err := Encode("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = b.PNG(&buf, Options{ModuleWidth: 3, Height: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := img.Bounds().Dx(); got != b.Width()*3 {
+		t.Fatalf("got width %d, want %d", got, b.Width()*3)
+	}
+	if got := img.Bounds().Dy(); got != 20 {
+		t.Fatalf("got height %d, want 20", got)
+	}
+	for module := -QuietZone; module < len(b.modules)+QuietZone; module++ {
+		bar := module >= 0 && module < len(b.modules) && b.modules[module]
+		for x := (module + QuietZone) * 3; x < (module+QuietZone+1)*3; x++ {
+			gray := color.GrayModel.Convert(img.At(x, 10)).(color.Gray)
+			if (gray.Y == 0) != bar {
+				t.Fatalf("got gray %d at x %d, want a bar: %t", gray.Y, x, bar)
+			}
+		}
+	}
+}
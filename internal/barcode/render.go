@@ -0,0 +1,81 @@
+package barcode
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// Options controls the size of a rendered barcode. ModuleWidth is the width of the
+// narrowest bar in pixels (or SVG user units), and Height is the height of the bars.
+type Options struct {
+	ModuleWidth int
+	Height      int
+	// ShowText adds the human-readable data below the bars. It is only supported by
+	// SVG(), as drawing text into a PNG would need a font.
+	ShowText bool
+}
+
+// DefaultOptions gives bars which scan reliably when printed on a standard label.
+var DefaultOptions = Options{ModuleWidth: 2, Height: 60, ShowText: true}
+
+// SVG writes the barcode to w as an SVG image. Runs of adjacent bar modules are merged
+// into a single rectangle to keep the output small.
+func (b *Barcode) SVG(w io.Writer, opts Options) error {
+	textHeight := 0
+	if opts.ShowText {
+		textHeight = 4*opts.ModuleWidth + 12
+	}
+	width := b.Width() * opts.ModuleWidth
+	height := opts.Height + textHeight
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+	fmt.Fprintf(&sb, `<rect width="%d" height="%d" fill="#fff"/>`, width, height)
+	for start := 0; start < len(b.modules); {
+		if !b.modules[start] {
+			start++
+			continue
+		}
+		end := start
+		for end < len(b.modules) && b.modules[end] {
+			end++
+		}
+		fmt.Fprintf(&sb, `<rect x="%d" width="%d" height="%d"/>`, (QuietZone+start)*opts.ModuleWidth, (end-start)*opts.ModuleWidth, opts.Height)
+		start = end
+	}
+	if opts.ShowText {
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" font-family="monospace" font-size="12" text-anchor="middle">%s</text>`,
+			width/2, height-2*opts.ModuleWidth, html.EscapeString(b.Data))
+	}
+	sb.WriteString(`</svg>`)
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// Image returns the barcode as a black and white image.
+func (b *Barcode) Image(opts Options) image.Image {
+	width := b.Width() * opts.ModuleWidth
+	img := image.NewGray(image.Rect(0, 0, width, opts.Height))
+	for x := range width {
+		module := x/opts.ModuleWidth - QuietZone
+		c := color.White
+		if module >= 0 && module < len(b.modules) && b.modules[module] {
+			c = color.Black
+		}
+		for y := range opts.Height {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// PNG writes the barcode to w as a PNG image. The human-readable text is never drawn.
+func (b *Barcode) PNG(w io.Writer, opts Options) error {
+	return png.Encode(w, b.Image(opts))
+}
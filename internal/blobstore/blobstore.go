@@ -0,0 +1,89 @@
+// Package blobstore keeps uploaded files on the local disk. Files are addressed by the
+// SHA-256 hash of their contents, so uploading the same file twice stores it once.
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	ErrNotFound   = errors.New("blobstore: blob not found")
+	ErrInvalidKey = errors.New("blobstore: invalid key")
+)
+
+var keyRX = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Store is a directory of blobs. Each blob is stored at <dir>/<first two characters of
+// the key>/<key>, to keep the number of files in any one directory manageable.
+type Store struct {
+	dir string
+}
+
+// New returns a Store which keeps its blobs in dir, creating the directory if it
+// doesn't exist yet.
+func New(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put copies r into the store and returns the key and size of the blob. The data is
+// written to a temporary file first and only moved into place once it has been read
+// in full, so a failed upload never leaves a partial blob behind.
+func (s *Store) Put(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(s.dir, "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(tmp, io.TeeReader(r, hash))
+	if err != nil {
+		return "", 0, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	key := hex.EncodeToString(hash.Sum(nil))
+	err = os.MkdirAll(filepath.Dir(s.path(key)), 0o750)
+	if err != nil {
+		return "", 0, err
+	}
+	err = os.Rename(tmp.Name(), s.path(key))
+	if err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+// Open opens the blob with the given key for reading. The caller must close it.
+func (s *Store) Open(key string) (*os.File, error) {
+	if !keyRX.MatchString(key) {
+		return nil, ErrInvalidKey
+	}
+
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.dir, key[:2], key)
+}
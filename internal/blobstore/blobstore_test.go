@@ -0,0 +1,128 @@
+package blobstore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPutAndOpen(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, size, err := s.Put(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The SHA-256 hash of "hello".
+	wantKey := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if key != wantKey || size != 5 {
+		t.Fatalf("got key %q and size %d, want %q and 5", key, size, wantKey)
+	}
+
+	// Storing the same content again gives the same blob.
+	again, _, err := s.Put(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != key {
+		t.Errorf("got key %q for the same content, want %q", again, key)
+	}
+
+	f, err := s.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("got content %q, want %q", content, "hello")
+	}
+
+	// Only the blob is left behind, under its two character directory.
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "2c" {
+		t.Errorf("got directory entries %v, want only 2c", entries)
+	}
+}
+
+func TestOpenKeys(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file outside the store, which traversing keys must not reach.
+	err = os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		key     string
+		wantErr error
+	}{
+		{"missing blob", missing, ErrNotFound},
+		{"empty", "", ErrInvalidKey},
+		{"too short", missing[:63], ErrInvalidKey},
+		{"too long", missing + "a", ErrInvalidKey},
+		{"uppercase", strings.ToUpper(missing), ErrInvalidKey},
+		{"not hex", strings.Repeat("g", 64), ErrInvalidKey},
+		{"path traversal", "../../secret", ErrInvalidKey},
+		{"padded traversal", "../" + missing[:61], ErrInvalidKey},
+		{"trailing newline", missing + "\n", ErrInvalidKey},
+		{"separator", missing[:32] + "/" + missing[:31], ErrInvalidKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := s.Open(tt.key)
+			if err == nil {
+				f.Close()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestPutFailure(t *testing.T) {
+	s, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = s.Put(io.MultiReader(strings.NewReader("partial"), failingReader{}))
+	if err == nil {
+		t.Fatal("got no error from a failing reader")
+	}
+
+	// The temporary file is removed, and no blob is stored.
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got directory entries %v after a failed upload, want none", entries)
+	}
+}
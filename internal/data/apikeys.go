@@ -0,0 +1,202 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// APIKeyPrefix starts every API key, so that keys are easy to recognize, for example by
+// secret scanners.
+const APIKeyPrefix = "mk_"
+
+// apiKeyLength is the length of API keys: the prefix and 32 base-32 characters.
+const apiKeyLength = len(APIKeyPrefix) + 32
+
+// APIKey is a key a service account authenticates with. It acts on behalf of the user
+// who created it, but only for the permissions in Scopes. Plaintext is only set when
+// the key is created.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UserID     int64      `json:"-"`
+	Name       string     `json:"name"`
+	Plaintext  string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Hash       []byte     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	Expiry     *time.Time `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// NewAPIKey returns a random API key. Only its hash is stored, along with enough of its
+// start to recognize it by.
+func NewAPIKey(userID int64, name string, scopes []string, expiry *time.Time) (*APIKey, error) {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	hash := sha256.Sum256([]byte(plaintext))
+	return &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Plaintext: plaintext,
+		Prefix:    plaintext[:len(APIKeyPrefix)+6],
+		Hash:      hash[:],
+		Scopes:    scopes,
+		Expiry:    expiry,
+	}, nil
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(key.Scopes), "scopes", "must not contain duplicate values")
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// ValidAPIKeyPlaintext reports whether key looks like an API key, so that malformed
+// keys can be rejected without a database lookup.
+func ValidAPIKeyPlaintext(key string) bool {
+	return len(key) == apiKeyLength && strings.HasPrefix(key, APIKeyPrefix)
+}
+
+// Define an APIKeyModel struct type which wraps a sql.DB connection pool.
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+	INSERT INTO api_keys (user_id, name, prefix, hash, scopes, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Scopes), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser() returns the API keys a user has created, including expired ones.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+	SELECT id, created_at, user_id, name, prefix, scopes, expiry, last_used_at
+	FROM api_keys
+	WHERE user_id = $1
+	ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Scopes),
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Delete() revokes one of a user's API keys.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	query := `
+	DELETE FROM api_keys
+	WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetForKey() returns the user an unexpired API key belongs to, along with the key,
+// and records that the key has been used. The time it was last used is only updated
+// once a minute, so that busy keys don't cause a write on every request.
+func (m APIKeyModel) GetForKey(plaintext string) (*User, *APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+	SELECT api_keys.id, api_keys.name, api_keys.prefix, api_keys.scopes, api_keys.expiry, api_keys.last_used_at,
+		` + userColumnsSQL + `
+	FROM users
+	INNER JOIN api_keys ON users.id = api_keys.user_id
+	WHERE api_keys.hash = $1
+	AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	key := APIKey{Hash: hash[:]}
+	err := scanUser(m.DB.QueryRowContext(ctx, query, hash[:], time.Now()), &user,
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Scopes),
+		&key.Expiry,
+		&key.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	key.UserID = user.ID
+
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > time.Minute {
+		_, err = m.DB.ExecContext(ctx, `UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`, key.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return &user, &key, nil
+}
@@ -0,0 +1,51 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// BookTx gives access to the book queries inside a single database transaction. It is
+// handed to the function passed to BookModel.Batch().
+type BookTx struct {
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+func (t BookTx) Get(id int64) (*Book, error) {
+	return getBook(t.ctx, t.tx, id)
+}
+
+func (t BookTx) Insert(book *Book) error {
+	return insertBook(t.ctx, t.tx, book)
+}
+
+func (t BookTx) Update(book *Book) error {
+	return updateBook(t.ctx, t.tx, book)
+}
+
+// Delete() deletes a book, returning ErrEditConflict if its version doesn't match.
+func (t BookTx) Delete(id int64, version int32) error {
+	return deleteBook(t.ctx, t.tx, id, version)
+}
+
+// Batch() runs fn inside a single transaction, so that a group of book changes is
+// applied all-or-nothing. If fn returns an error the transaction is rolled back and
+// the error is passed back to the caller; otherwise the transaction is committed.
+func (m BookModel) Batch(fn func(tx BookTx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(BookTx{ctx: ctx, tx: tx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -18,7 +18,20 @@ type Book struct {
 	Year      int32     `json:"year,omitempty"`
 	PageCount int32     `json:"pageCount,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ISBN      string    `json:"isbn,omitempty"`
+	Language  string    `json:"language,omitempty"`
+	// Rating and RatingsCount are aggregated from the visible reviews of the book and
+	// are maintained by the ReviewModel, so they are never written by BookModel.
+	Rating       float64 `json:"rating,omitempty"`
+	RatingsCount int32   `json:"ratingsCount,omitempty"`
+	// Shelves lists the shelves of the authenticated user that the book is on. It is
+	// filled in by the handlers, and is empty for anonymous requests.
+	Shelves []string `json:"shelves,omitempty"`
+	// AvailableCopies is the number of copies on the shelf at the branch given in the
+	// request's branch filter. It is filled in by the handlers, and is nil when no
+	// branch was requested.
+	AvailableCopies *int32 `json:"availableCopies,omitempty"`
+	Version         int32  `json:"version"`
 }
 
 func ValidateBook(v *validator.Validator, book *Book) {
@@ -33,6 +46,15 @@ func ValidateBook(v *validator.Validator, book *Book) {
 	v.Check(len(book.Genres) >= 1, "genres", "must contain at least 1 genre")
 	v.Check(len(book.Genres) <= 5, "genres", "must not contain more than 5 genres")
 	v.Check(validator.Unique(book.Genres), "genres", "must not contain duplicate values")
+	// The ISBN is optional too. Handlers normalize it with NormalizeISBN() first, so
+	// both ISBN-10 and ISBN-13 input is accepted.
+	if book.ISBN != "" {
+		v.Check(ValidISBN(book.ISBN), "isbn", "must be a valid ISBN")
+	}
+	// The language is optional, but when it is given it must be an ISO 639-1 code.
+	if book.Language != "" {
+		ValidateLanguage(v, book.Language)
+	}
 }
 
 // Define a BookModel struct type which wraps a sql.DB connection pool.
@@ -40,19 +62,93 @@ type BookModel struct {
 	DB *sql.DB
 }
 
-func (m BookModel) GetAll(title string, genres []string, filters Filters) ([]*Book, Metadata, error) { // Construct the SQL query to retrieve all book records.
+// bookGenresSQL selects the canonical names of the genres attached to the book in the
+// current row as a text array, so that it can be scanned straight into Book.Genres.
+const bookGenresSQL = `ARRAY(
+		SELECT genres.name::text
+		FROM books_genres
+		INNER JOIN genres ON genres.id = books_genres.genre_id
+		WHERE books_genres.book_id = books.id
+		ORDER BY genres.name)`
+
+// bookColumnsSQL lists the columns scanned by queryBooks(), for queries which return
+// books without pagination metadata.
+const bookColumnsSQL = `books.id, books.created_at, books.title, books.year, books.page_count, ` +
+	bookGenresSQL + `, books.isbn, books.language, books.rating, books.ratings_count, books.version`
+
+// queryBooks() runs a query which selects bookColumnsSQL and returns the resulting
+// books.
+func queryBooks(ctx context.Context, db *sql.DB, query string, args ...any) ([]*Book, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []*Book{}
+	for rows.Next() {
+		var book Book
+		err := rows.Scan(
+			&book.ID,
+			&book.CreatedAt,
+			&book.Title,
+			&book.Year,
+			&book.PageCount,
+			pq.Array(&book.Genres),
+			&book.ISBN,
+			&book.Language,
+			&book.Rating,
+			&book.RatingsCount,
+			&book.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, &book)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+func (m BookModel) GetAll(title string, genres []string, language string, branchID int64, filters Filters) ([]*Book, Metadata, error) { // Construct the SQL query to retrieve all book records.
+	// Each requested genre (or alias) is expanded to itself plus all of its
+	// descendants, so that filtering on "fiction" also matches "science fiction". A
+	// book matches when it carries a genre from every requested branch. Terms are
+	// compared trimmed and case-insensitively, so that repeating a term doesn't make
+	// the filter impossible to satisfy.
 	query := fmt.Sprintf(`
-	SELECT count(*) OVER(), id, created_at, title, year, page_count, genres, version
+	WITH RECURSIVE requested AS (
+		SELECT trim(terms.term)::citext AS term, genres.id AS genre_id
+		FROM unnest($2::text[]) AS terms(term)
+		INNER JOIN genres ON genres.name = trim(terms.term)::citext
+			OR genres.id = (SELECT genre_id FROM genre_aliases WHERE alias = trim(terms.term)::citext)
+		UNION
+		SELECT requested.term, genres.id
+		FROM genres INNER JOIN requested ON genres.parent_id = requested.genre_id
+	)
+	SELECT count(*) OVER(), id, created_at, title, year, page_count, %s, isbn, language, rating, ratings_count, version
 	FROM books
-	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-	AND (genres @> $2 OR $2 = '{}')
+	WHERE (to_tsvector(search_config, title) @@ plainto_tsquery(search_config, $1) OR $1 = '')
+	AND (language = $5 OR $5 = '')
+	AND ($6 = 0 OR EXISTS (
+		SELECT 1 FROM copies
+		WHERE copies.book_id = books.id AND copies.current_branch_id = $6 AND copies.status = 'available'
+	))
+	AND (cardinality($2::text[]) = 0 OR (
+		SELECT count(DISTINCT requested.term)
+		FROM requested
+		INNER JOIN books_genres ON books_genres.genre_id = requested.genre_id
+		WHERE books_genres.book_id = books.id
+	) = (SELECT count(DISTINCT trim(terms.term)::citext) FROM unnest($2::text[]) AS terms(term)))
 	ORDER BY %s %s, id ASC
-	LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	LIMIT $3 OFFSET $4`, bookGenresSQL, filters.sortColumn(), filters.sortDirection())
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{title, pq.Array(genres), filters.limit(), filters.offset(), language, branchID}
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 
@@ -79,6 +175,10 @@ func (m BookModel) GetAll(title string, genres []string, filters Filters) ([]*Bo
 			&book.Year,
 			&book.PageCount,
 			pq.Array(&book.Genres),
+			&book.ISBN,
+			&book.Language,
+			&book.Rating,
+			&book.RatingsCount,
 			&book.Version,
 		)
 		if err != nil {
@@ -101,44 +201,108 @@ func (m BookModel) GetAll(title string, genres []string, filters Filters) ([]*Bo
 	return books, metadata, nil
 }
 
+// queryer is satisfied by both *sql.DB and *sql.Tx, so that the book queries below can
+// run either on their own or as part of a larger transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 // The Insert() method accepts a pointer to a book struct, which should contain the
-// data for the new record.
+// data for the new record. The book's genres are resolved against the genre taxonomy
+// and an ErrUnknownGenre error is returned if any of them doesn't exist.
 func (m BookModel) Insert(book *Book) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
+	err = insertBook(ctx, tx, book)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertBook(ctx context.Context, tx *sql.Tx, book *Book) error {
 	query := `
-	INSERT INTO books (title, year, page_count, genres)
-	VALUES ($1, $2, $3, $4)
+	INSERT INTO books (title, year, page_count, isbn, language, search_config)
+	VALUES ($1, $2, $3, $4, $5, $6::regconfig)
 	RETURNING id, created_at, version`
 
-	args := []any{book.Title, book.Year, book.PageCount, pq.Array(book.Genres)}
+	// The search_config column holds the text search configuration for the book's
+	// language, so that the title is stemmed according to the rules of that language.
+	args := []any{book.Title, book.Year, book.PageCount, book.ISBN, book.Language, textSearchConfig(book.Language)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
 	// Use QueryRowContext() and pass the context as the first argument.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.Version)
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.Version)
+	if err != nil {
+		return err
+	}
+
+	return setBookGenres(ctx, tx, book)
+}
+
+// setBookGenres() replaces the genres attached to a book with the ones named in
+// book.Genres, and then normalizes book.Genres to the canonical genre names.
+func setBookGenres(ctx context.Context, tx *sql.Tx, book *Book) error {
+	ids, names, err := resolveGenres(ctx, tx, book.Genres)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM books_genres WHERE book_id = $1`, book.ID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO books_genres (book_id, genre_id)
+	SELECT $1, genre_id FROM unnest($2::bigint[]) AS genre_id`
+
+	_, err = tx.ExecContext(ctx, query, book.ID, pq.Array(ids))
+	if err != nil {
+		return err
+	}
 
+	book.Genres = names
+	return nil
 }
 
 func (m BookModel) Get(id int64) (*Book, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return getBook(ctx, m.DB, id)
+}
+
+func getBook(ctx context.Context, q queryer, id int64) (*Book, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-	SELECT id, created_at, title, year, page_count, genres, version
+	SELECT id, created_at, title, year, page_count, ` + bookGenresSQL + `, isbn, language, rating, ratings_count, version
 	FROM books
 	WHERE id = $1`
 	var book Book
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := q.QueryRowContext(ctx, query, id).Scan(
 		&book.ID,
 		&book.CreatedAt,
 		&book.Title,
 		&book.Year,
 		&book.PageCount,
 		pq.Array(&book.Genres),
+		&book.ISBN,
+		&book.Language,
+		&book.Rating,
+		&book.RatingsCount,
 		&book.Version,
 	)
 	if err != nil {
@@ -154,27 +318,44 @@ func (m BookModel) Get(id int64) (*Book, error) {
 
 // Add a placeholder method for updating a specific record in the books table.
 func (m BookModel) Update(book *Book) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = updateBook(ctx, tx, book)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateBook(ctx context.Context, tx *sql.Tx, book *Book) error {
 	// Declare the SQL query for updating the record and returning the new version
 	// number.
 	query := `
 		UPDATE books
-		SET title = $1, year = $2, page_count = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET title = $1, year = $2, page_count = $3, isbn = $4, language = $5, search_config = $6::regconfig,
+			version = version + 1
+		WHERE id = $7 AND version = $8
 		RETURNING version`
 
 	args := []any{
 		book.Title,
 		book.Year,
 		book.PageCount,
-		pq.Array(book.Genres),
+		book.ISBN,
+		book.Language,
+		textSearchConfig(book.Language),
 		book.ID,
 		book.Version, // Add the expected book version.
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&book.Version)
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&book.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -183,23 +364,30 @@ func (m BookModel) Update(book *Book) error {
 			return err
 		}
 	}
-	return nil
+
+	return setBookGenres(ctx, tx, book)
 }
 
 // Add a placeholder method for deleting a specific record from the books table.
 func (m BookModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return deleteBook(ctx, m.DB, id, 0)
+}
+
+// deleteBook() deletes a book. If version is non-zero the book is only deleted when
+// its version still matches, and an ErrEditConflict error is returned otherwise.
+func deleteBook(ctx context.Context, q queryer, id int64, version int32) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
 		DELETE FROM books
-		WHERE id = $1`
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+		WHERE id = $1 AND ($2 = 0 OR version = $2)`
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := q.ExecContext(ctx, query, id, version)
 	if err != nil {
 		return err
 	}
@@ -209,11 +397,18 @@ func (m BookModel) Delete(id int64) error {
 	if err != nil {
 		return err
 	}
-	// If no rows were affected, we know that the books table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
+	// If no rows were affected, either the books table didn't contain a record with
+	// the provided ID at the moment we tried to delete it, or its version had moved
+	// on. We tell the two cases apart so that the client gets the right response.
 	if rowsAffected == 0 {
-		return ErrRecordNotFound
+		if version == 0 {
+			return ErrRecordNotFound
+		}
+		_, err = getBook(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		return ErrEditConflict
 	}
 	return nil
 }
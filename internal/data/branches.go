@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+var (
+	ErrDuplicateBranch = errors.New("duplicate branch")
+	ErrBranchInUse     = errors.New("branch in use")
+)
+
+// Branch is a physical library location which holds copies of books.
+type Branch struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	Address   string    `json:"address,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateBranch(v *validator.Validator, branch *Branch) {
+	v.Check(strings.TrimSpace(branch.Name) != "", "name", "must be provided")
+	v.Check(len(branch.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(branch.Address) <= 500, "address", "must not be more than 500 bytes long")
+}
+
+// Define a BranchModel struct type which wraps a sql.DB connection pool.
+type BranchModel struct {
+	DB *sql.DB
+}
+
+func (m BranchModel) GetAll() ([]*Branch, error) {
+	query := `
+	SELECT id, created_at, name, address, version
+	FROM branches
+	ORDER BY name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	branches := []*Branch{}
+	for rows.Next() {
+		var branch Branch
+		err := rows.Scan(&branch.ID, &branch.CreatedAt, &branch.Name, &branch.Address, &branch.Version)
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, &branch)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return branches, nil
+}
+
+func (m BranchModel) Get(id int64) (*Branch, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, name, address, version
+	FROM branches
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var branch Branch
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&branch.ID, &branch.CreatedAt, &branch.Name, &branch.Address, &branch.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &branch, nil
+}
+
+// Insert() creates a new branch. It returns ErrDuplicateBranch if another branch
+// already has the same name.
+func (m BranchModel) Insert(branch *Branch) error {
+	query := `
+	INSERT INTO branches (name, address)
+	VALUES ($1, $2)
+	RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, branch.Name, branch.Address).Scan(&branch.ID, &branch.CreatedAt, &branch.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "branches_name_key"`:
+			return ErrDuplicateBranch
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m BranchModel) Update(branch *Branch) error {
+	query := `
+	UPDATE branches
+	SET name = $1, address = $2, version = version + 1
+	WHERE id = $3 AND version = $4
+	RETURNING version`
+
+	args := []any{branch.Name, branch.Address, branch.ID, branch.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&branch.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case err.Error() == `pq: duplicate key value violates unique constraint "branches_name_key"`:
+			return ErrDuplicateBranch
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes a branch. Branches which are still the home or current branch of a
+// copy, or which appear in a transfer or stocktake, can't be deleted and return
+// ErrBranchInUse.
+func (m BranchModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM branches
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		switch {
+		case strings.HasPrefix(err.Error(), `pq: update or delete on table "branches" violates foreign key constraint`):
+			return ErrBranchInUse
+		default:
+			return err
+		}
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
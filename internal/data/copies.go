@@ -0,0 +1,298 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// A copy is either on the shelf at its current branch, in transit between two branches
+// while a transfer is under way, or missing after it wasn't found during a stocktake.
+const (
+	CopyAvailable = "available"
+	CopyInTransit = "in_transit"
+	CopyMissing   = "missing"
+)
+
+var (
+	ErrUnknownBranch = errors.New("unknown branch")
+)
+
+// Copy is a single physical item of a book. HomeBranchID is the branch the copy
+// belongs to, and CurrentBranchID is where it is right now. CurrentBranchID is nil
+// while the copy is in transit.
+type Copy struct {
+	ID              int64     `json:"id"`
+	CreatedAt       time.Time `json:"-"`
+	Barcode         string    `json:"barcode"`
+	BookID          int64     `json:"book_id"`
+	HomeBranchID    int64     `json:"home_branch_id"`
+	CurrentBranchID *int64    `json:"current_branch_id,omitempty"`
+	Location        string    `json:"location,omitempty"`
+	Status          string    `json:"status"`
+	Version         int32     `json:"version"`
+}
+
+func ValidateCopy(v *validator.Validator, copy *Copy) {
+	v.Check(copy.HomeBranchID != 0, "home_branch_id", "must be provided")
+	v.Check(copy.HomeBranchID > 0, "home_branch_id", "must be a positive integer")
+	v.Check(len(copy.Location) <= 50, "location", "must not be more than 50 bytes long")
+}
+
+// Define a CopyModel struct type which wraps a sql.DB connection pool.
+type CopyModel struct {
+	DB *sql.DB
+}
+
+// GetAllForBook() returns the copies of a book. If branchID is non-zero only the copies
+// currently at that branch are returned.
+func (m CopyModel) GetAllForBook(bookID, branchID int64) ([]*Copy, error) {
+	query := `
+	SELECT id, created_at, barcode, book_id, home_branch_id, current_branch_id, location, status, version
+	FROM copies
+	WHERE book_id = $1 AND (current_branch_id = $2 OR $2 = 0)
+	ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, bookID, branchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	copies := []*Copy{}
+	for rows.Next() {
+		var copy Copy
+		err := rows.Scan(
+			&copy.ID,
+			&copy.CreatedAt,
+			&copy.Barcode,
+			&copy.BookID,
+			&copy.HomeBranchID,
+			&copy.CurrentBranchID,
+			&copy.Location,
+			&copy.Status,
+			&copy.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, &copy)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return copies, nil
+}
+
+func (m CopyModel) Get(id int64) (*Copy, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, barcode, book_id, home_branch_id, current_branch_id, location, status, version
+	FROM copies
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var copy Copy
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&copy.ID,
+		&copy.CreatedAt,
+		&copy.Barcode,
+		&copy.BookID,
+		&copy.HomeBranchID,
+		&copy.CurrentBranchID,
+		&copy.Location,
+		&copy.Status,
+		&copy.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &copy, nil
+}
+
+// Insert() adds a new copy of a book, shelved at its home branch. It returns
+// ErrRecordNotFound if the book doesn't exist and ErrUnknownBranch if the home branch
+// doesn't exist.
+func (m CopyModel) Insert(copy *Copy) error {
+	query := `
+	INSERT INTO copies (book_id, home_branch_id, current_branch_id, location)
+	VALUES ($1, $2, $2, $3)
+	RETURNING id, created_at, barcode, current_branch_id, status, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, copy.BookID, copy.HomeBranchID, copy.Location).Scan(
+		&copy.ID,
+		&copy.CreatedAt,
+		&copy.Barcode,
+		&copy.CurrentBranchID,
+		&copy.Status,
+		&copy.Version,
+	)
+	if err != nil {
+		return copyWriteError(err)
+	}
+	return nil
+}
+
+// Update() changes the home branch and shelf location of a copy. The copy stays at its
+// current branch, so moving it to a new home branch is done with a transfer.
+func (m CopyModel) Update(copy *Copy) error {
+	query := `
+	UPDATE copies
+	SET home_branch_id = $1, location = $2, version = version + 1
+	WHERE id = $3 AND version = $4
+	RETURNING version`
+
+	args := []any{copy.HomeBranchID, copy.Location, copy.ID, copy.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&copy.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return copyWriteError(err)
+		}
+	}
+	return nil
+}
+
+// Delete() withdraws a copy, along with its transfer history.
+func (m CopyModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM copies
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// CountAvailable() returns the number of copies of each of the given books which are
+// available at a branch. Books without any available copies are left out of the map.
+func (m CopyModel) CountAvailable(branchID int64, bookIDs []int64) (map[int64]int32, error) {
+	query := `
+	SELECT book_id, count(*)
+	FROM copies
+	WHERE current_branch_id = $1 AND status = 'available' AND book_id = ANY($2)
+	GROUP BY book_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, branchID, pq.Array(bookIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int32)
+	for rows.Next() {
+		var bookID int64
+		var count int32
+		err := rows.Scan(&bookID, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[bookID] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// CopyLabel holds the details printed on the spine and barcode label of a copy.
+type CopyLabel struct {
+	CopyID  int64
+	Barcode string
+	Title   string
+	Year    int32
+	Branch  string
+}
+
+// GetLabels() returns the label details of the given copies, in the order the IDs were
+// given. IDs which don't match a copy are skipped.
+func (m CopyModel) GetLabels(ids []int64) ([]*CopyLabel, error) {
+	query := `
+	SELECT copies.id, copies.barcode, books.title, books.year, branches.name
+	FROM unnest($1::bigint[]) WITH ORDINALITY AS requested(id, position)
+	INNER JOIN copies ON copies.id = requested.id
+	INNER JOIN books ON books.id = copies.book_id
+	INNER JOIN branches ON branches.id = copies.home_branch_id
+	ORDER BY requested.position`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []*CopyLabel{}
+	for rows.Next() {
+		var label CopyLabel
+		err := rows.Scan(&label.CopyID, &label.Barcode, &label.Title, &label.Year, &label.Branch)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, &label)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// copyWriteError() maps the foreign key violations raised when writing a copy onto
+// our own errors.
+func copyWriteError(err error) error {
+	switch {
+	case err.Error() == `pq: insert or update on table "copies" violates foreign key constraint "copies_book_id_fkey"`:
+		return ErrRecordNotFound
+	case err.Error() == `pq: insert or update on table "copies" violates foreign key constraint "copies_home_branch_id_fkey"`:
+		return ErrUnknownBranch
+	default:
+		return err
+	}
+}
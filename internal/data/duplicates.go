@@ -0,0 +1,243 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DuplicateCandidate is a pair of books which look like they describe the same
+// edition. Score is between 0 and 1, and Reasons lists the signals that matched
+// ("isbn", "title" and/or "year").
+type DuplicateCandidate struct {
+	Book      *Book    `json:"book"`
+	Duplicate *Book    `json:"duplicate"`
+	Score     float64  `json:"score"`
+	Reasons   []string `json:"reasons"`
+}
+
+// GetDuplicates() finds pairs of likely duplicate books. Two books are flagged when
+// they share an ISBN, or when their normalized titles have a trigram similarity of at
+// least minSimilarity and their publication years are at most a year apart. Pairs are
+// returned with the most likely duplicates first.
+func (m BookModel) GetDuplicates(minSimilarity float64, filters Filters) ([]*DuplicateCandidate, Metadata, error) {
+	query := `
+	WITH candidates AS (
+		SELECT a.id AS book_id, b.id AS duplicate_id,
+			a.isbn <> '' AND a.isbn = b.isbn AS same_isbn,
+			similarity(a.title_normalized, b.title_normalized) AS title_score,
+			abs(a.year - b.year) <= 1 AS close_year
+		FROM books AS a
+		INNER JOIN books AS b ON a.id < b.id
+			AND ((a.isbn <> '' AND a.isbn = b.isbn) OR a.title_normalized % b.title_normalized)
+	),
+	scored AS (
+		SELECT book_id, duplicate_id, same_isbn, title_score, close_year,
+			CASE WHEN same_isbn THEN 1 ELSE title_score END AS score
+		FROM candidates
+		WHERE same_isbn OR (title_score >= $1 AND close_year)
+	)
+	SELECT count(*) OVER(), book_id, duplicate_id, score,
+		array_remove(ARRAY[
+			CASE WHEN same_isbn THEN 'isbn' END,
+			CASE WHEN title_score >= $1 THEN 'title' END,
+			CASE WHEN close_year THEN 'year' END
+		], NULL)
+	FROM scored
+	ORDER BY score DESC, book_id ASC, duplicate_id ASC
+	LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, minSimilarity, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	candidates := []*DuplicateCandidate{}
+	var ids []int64
+	for rows.Next() {
+		var bookID, duplicateID int64
+		candidate := &DuplicateCandidate{}
+		err := rows.Scan(&totalRecords, &bookID, &duplicateID, &candidate.Score, pq.Array(&candidate.Reasons))
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		candidate.Book = &Book{ID: bookID}
+		candidate.Duplicate = &Book{ID: duplicateID}
+		candidates = append(candidates, candidate)
+		ids = append(ids, bookID, duplicateID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// Load the full details of every book involved in a single query.
+	books, err := queryBooks(ctx, m.DB, `SELECT `+bookColumnsSQL+` FROM books WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	byID := make(map[int64]*Book, len(books))
+	for _, book := range books {
+		byID[book.ID] = book
+	}
+	for _, candidate := range candidates {
+		candidate.Book = byID[candidate.Book.ID]
+		candidate.Duplicate = byID[candidate.Duplicate.ID]
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return candidates, metadata, nil
+}
+
+// Merge() folds the source book into the target book in a single transaction. The
+// source's reviews and shelf entries move to the target (where the same user already
+// has one for the target, the target's is kept), its copies and ebooks (along with
+// their loans) become those of the target, suggestions it fulfilled point at the
+// target, the aggregate rating is refreshed, and the source is deleted. A redirect
+// from the source ID to the target is recorded, and any redirects which pointed at
+// the source are re-pointed at the target.
+func (m BookModel) Merge(sourceID, targetID int64) (*Book, error) {
+	if sourceID < 1 || targetID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock both books, in ID order so that two concurrent merges can't deadlock.
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM books WHERE id = ANY($1) ORDER BY id FOR UPDATE`, pq.Array([]int64{sourceID, targetID}))
+	if err != nil {
+		return nil, err
+	}
+	locked := 0
+	for rows.Next() {
+		locked++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if locked != 2 {
+		return nil, ErrRecordNotFound
+	}
+
+	statements := []string{
+		// Reviews: users can only review a book once, so a user's review of the
+		// source is dropped if they already reviewed the target.
+		`UPDATE reviews SET book_id = $2
+		WHERE book_id = $1
+		AND user_id NOT IN (SELECT user_id FROM reviews WHERE book_id = $2)`,
+		// Custom shelves can simply be merged.
+		`INSERT INTO shelves_books (shelf_id, book_id, added_at)
+		SELECT shelves_books.shelf_id, $2, shelves_books.added_at
+		FROM shelves_books
+		INNER JOIN shelves ON shelves.id = shelves_books.shelf_id
+		WHERE shelves_books.book_id = $1 AND NOT shelves.builtin
+		ON CONFLICT DO NOTHING`,
+		// Built-in shelves hold the reading status, so the source's status is only
+		// carried over for users who don't already have a status for the target.
+		`INSERT INTO shelves_books (shelf_id, book_id, added_at)
+		SELECT shelves_books.shelf_id, $2, shelves_books.added_at
+		FROM shelves_books
+		INNER JOIN shelves ON shelves.id = shelves_books.shelf_id
+		WHERE shelves_books.book_id = $1 AND shelves.builtin
+		AND NOT EXISTS (
+			SELECT 1 FROM shelves_books AS existing
+			INNER JOIN shelves AS existing_shelves ON existing_shelves.id = existing.shelf_id
+			WHERE existing.book_id = $2 AND existing_shelves.builtin
+			AND existing_shelves.user_id = shelves.user_id
+		)`,
+		// Physical copies simply become copies of the surviving book.
+		`UPDATE copies SET book_id = $2, version = version + 1 WHERE book_id = $1`,
+		// So do ebooks, which keeps their loans, as deleting the source would
+		// otherwise delete them.
+		`UPDATE ebooks SET book_id = $2, version = version + 1 WHERE book_id = $1`,
+		`UPDATE suggestions SET book_id = $2, version = version + 1 WHERE book_id = $1`,
+		`UPDATE book_redirects SET book_id = $2 WHERE book_id = $1`,
+		`INSERT INTO book_redirects (old_id, book_id) VALUES ($1, $2)`,
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement, sourceID, targetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The delete only takes the source ID, as PostgreSQL rejects arguments which the
+	// statement doesn't use.
+	_, err = tx.ExecContext(ctx, `DELETE FROM books WHERE id = $1`, sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = refreshBookRating(ctx, tx, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+	UPDATE books SET version = version + 1
+	WHERE id = $1
+	RETURNING ` + bookColumnsSQL
+
+	var book Book
+	err = tx.QueryRowContext(ctx, query, targetID).Scan(
+		&book.ID,
+		&book.CreatedAt,
+		&book.Title,
+		&book.Year,
+		&book.PageCount,
+		pq.Array(&book.Genres),
+		&book.ISBN,
+		&book.Language,
+		&book.Rating,
+		&book.RatingsCount,
+		&book.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// GetRedirect() returns the ID of the book that a merged book ID now points at, or
+// ErrRecordNotFound if the ID was never merged.
+func (m BookModel) GetRedirect(oldID int64) (int64, error) {
+	query := `
+	SELECT book_id
+	FROM book_redirects
+	WHERE old_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var bookID int64
+	err := m.DB.QueryRowContext(ctx, query, oldID).Scan(&bookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return bookID, nil
+}
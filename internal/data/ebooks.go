@@ -0,0 +1,424 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+var (
+	ErrNoLicenseAvailable = errors.New("no license available")
+	ErrAlreadyBorrowed    = errors.New("ebook already borrowed")
+)
+
+// EbookContentTypes maps the supported ebook formats onto the content type the files
+// are served with.
+var EbookContentTypes = map[string]string{
+	"epub": "application/epub+zip",
+	"pdf":  "application/pdf",
+}
+
+// Ebook is a digital file of a book. Licenses is the number of patrons who may have
+// the file on loan at the same time, and AvailableLicenses how many of those are free
+// right now. BlobKey locates the file in the blob store and is never sent to clients.
+type Ebook struct {
+	ID                int64     `json:"id"`
+	CreatedAt         time.Time `json:"created_at"`
+	BookID            int64     `json:"book_id"`
+	Format            string    `json:"format"`
+	Filename          string    `json:"filename"`
+	ContentType       string    `json:"content_type"`
+	BlobKey           string    `json:"-"`
+	Size              int64     `json:"size"`
+	Licenses          int32     `json:"licenses"`
+	AvailableLicenses int32     `json:"available_licenses"`
+	Version           int32     `json:"version"`
+}
+
+func ValidateEbook(v *validator.Validator, ebook *Ebook) {
+	v.Check(validator.PermittedValue(ebook.Format, "epub", "pdf"), "format", "must be epub or pdf")
+	v.Check(strings.TrimSpace(ebook.Filename) != "", "filename", "must be provided")
+	v.Check(len(ebook.Filename) <= 255, "filename", "must not be more than 255 bytes long")
+	v.Check(!strings.ContainsAny(ebook.Filename, "/\\\x00"), "filename", "must not contain slashes")
+	v.Check(ebook.Licenses > 0, "licenses", "must be greater than zero")
+	v.Check(ebook.Licenses <= 1000, "licenses", "must not be more than 1000")
+}
+
+// activeLoanSQL matches the ebook loans which still hold a license. A loan gives its
+// license back when it is returned or falls due, whichever comes first.
+const activeLoanSQL = `ebook_loans.returned_at IS NULL AND ebook_loans.due_at > NOW()`
+
+// ebookColumnsSQL lists the columns scanned by scanEbook(). The columns are qualified
+// so that the list can be used in queries joining other tables.
+const ebookColumnsSQL = `ebooks.id, ebooks.created_at, ebooks.book_id, ebooks.format, ebooks.filename,
+	ebooks.content_type, ebooks.blob_key, ebooks.size, ebooks.licenses,
+	ebooks.licenses - (SELECT count(*) FROM ebook_loans WHERE ebook_loans.ebook_id = ebooks.id AND ` + activeLoanSQL + `),
+	ebooks.version`
+
+func scanEbook(row scanner, ebook *Ebook, extra ...any) error {
+	dest := append(extra,
+		&ebook.ID,
+		&ebook.CreatedAt,
+		&ebook.BookID,
+		&ebook.Format,
+		&ebook.Filename,
+		&ebook.ContentType,
+		&ebook.BlobKey,
+		&ebook.Size,
+		&ebook.Licenses,
+		&ebook.AvailableLicenses,
+		&ebook.Version,
+	)
+	return row.Scan(dest...)
+}
+
+// Define an EbookModel struct type which wraps a sql.DB connection pool.
+type EbookModel struct {
+	DB *sql.DB
+}
+
+func (m EbookModel) GetAllForBook(bookID int64) ([]*Ebook, error) {
+	query := `SELECT ` + ebookColumnsSQL + ` FROM ebooks WHERE ebooks.book_id = $1 ORDER BY ebooks.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ebooks := []*Ebook{}
+	for rows.Next() {
+		var ebook Ebook
+		err := scanEbook(rows, &ebook)
+		if err != nil {
+			return nil, err
+		}
+		ebooks = append(ebooks, &ebook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ebooks, nil
+}
+
+func (m EbookModel) Get(id int64) (*Ebook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + ebookColumnsSQL + ` FROM ebooks WHERE ebooks.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var ebook Ebook
+	err := scanEbook(m.DB.QueryRowContext(ctx, query, id), &ebook)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &ebook, nil
+}
+
+// Insert() records an ebook whose file is already in the blob store. It returns
+// ErrRecordNotFound if the book doesn't exist.
+func (m EbookModel) Insert(ebook *Ebook) error {
+	query := `
+	INSERT INTO ebooks (book_id, format, filename, content_type, blob_key, size, licenses)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id, created_at, licenses, version`
+
+	args := []any{ebook.BookID, ebook.Format, ebook.Filename, ebook.ContentType, ebook.BlobKey, ebook.Size, ebook.Licenses}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&ebook.ID, &ebook.CreatedAt, &ebook.AvailableLicenses, &ebook.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "ebooks" violates foreign key constraint "ebooks_book_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Update() changes the filename and number of licenses of an ebook. Lowering the
+// number of licenses doesn't end any loans; new loans are refused until enough of the
+// existing ones have ended.
+func (m EbookModel) Update(ebook *Ebook) error {
+	query := `
+	UPDATE ebooks
+	SET filename = $1, licenses = $2, version = version + 1
+	WHERE id = $3 AND version = $4
+	RETURNING ` + ebookColumnsSQL
+
+	args := []any{ebook.Filename, ebook.Licenses, ebook.ID, ebook.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := scanEbook(m.DB.QueryRowContext(ctx, query, args...), ebook)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes an ebook along with its loans. The file stays in the blob store, as
+// blobs are shared between ebooks with identical contents.
+func (m EbookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM ebooks
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// EbookLoan is a patron's loan of an ebook. The loan ends when it is returned or when
+// DueAt passes, whichever comes first. DownloadURL is filled in by the handlers.
+type EbookLoan struct {
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UserID      int64      `json:"user_id"`
+	DueAt       time.Time  `json:"due_at"`
+	ReturnedAt  *time.Time `json:"returned_at,omitempty"`
+	Ebook       *Ebook     `json:"ebook"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+// Define an EbookLoanModel struct type which wraps a sql.DB connection pool.
+type EbookLoanModel struct {
+	DB *sql.DB
+}
+
+// ebookLoanColumnsSQL lists the columns scanned by scanEbookLoan(), for queries joining
+// ebook_loans with ebooks.
+const ebookLoanColumnsSQL = `ebook_loans.id, ebook_loans.created_at, ebook_loans.user_id, ebook_loans.due_at,
+	ebook_loans.returned_at, ` + ebookColumnsSQL
+
+func scanEbookLoan(row scanner, loan *EbookLoan) error {
+	loan.Ebook = &Ebook{}
+	return scanEbook(row, loan.Ebook, &loan.ID, &loan.CreatedAt, &loan.UserID, &loan.DueAt, &loan.ReturnedAt)
+}
+
+// Insert() lends the ebook loan.Ebook.ID to a user until loan.DueAt. The ebook row is
+// locked while the active loans are counted, so that two patrons can't take the last
+// license at the same time. It returns ErrRecordNotFound if the ebook doesn't exist,
+// ErrAlreadyBorrowed if the user already has it on loan, and ErrNoLicenseAvailable if
+// every license is in use.
+func (m EbookLoanModel) Insert(loan *EbookLoan) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + ebookColumnsSQL + ` FROM ebooks WHERE ebooks.id = $1 FOR UPDATE`
+
+	ebook := &Ebook{}
+	err = scanEbook(tx.QueryRowContext(ctx, query, loan.Ebook.ID), ebook)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	query = `
+	SELECT EXISTS (
+		SELECT 1 FROM ebook_loans
+		WHERE ebook_loans.ebook_id = $1 AND ebook_loans.user_id = $2 AND ` + activeLoanSQL + `
+	)`
+
+	var borrowed bool
+	err = tx.QueryRowContext(ctx, query, ebook.ID, loan.UserID).Scan(&borrowed)
+	if err != nil {
+		return err
+	}
+	if borrowed {
+		return ErrAlreadyBorrowed
+	}
+	if ebook.AvailableLicenses < 1 {
+		return ErrNoLicenseAvailable
+	}
+
+	query = `
+	INSERT INTO ebook_loans (ebook_id, user_id, due_at)
+	VALUES ($1, $2, $3)
+	RETURNING id, created_at`
+
+	err = tx.QueryRowContext(ctx, query, ebook.ID, loan.UserID, loan.DueAt).Scan(&loan.ID, &loan.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	ebook.AvailableLicenses--
+	loan.Ebook = ebook
+	return tx.Commit()
+}
+
+// GetAllActiveForUser() returns a user's active loans, the soonest due first.
+func (m EbookLoanModel) GetAllActiveForUser(userID int64) ([]*EbookLoan, error) {
+	query := `
+	SELECT ` + ebookLoanColumnsSQL + `
+	FROM ebook_loans
+	INNER JOIN ebooks ON ebooks.id = ebook_loans.ebook_id
+	WHERE ebook_loans.user_id = $1 AND ` + activeLoanSQL + `
+	ORDER BY ebook_loans.due_at, ebook_loans.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loans := []*EbookLoan{}
+	for rows.Next() {
+		var loan EbookLoan
+		err := scanEbookLoan(rows, &loan)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, &loan)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return loans, nil
+}
+
+// GetAllForUser() returns every loan a user has had, including those which have ended,
+// the newest first.
+func (m EbookLoanModel) GetAllForUser(userID int64) ([]*EbookLoan, error) {
+	query := `
+	SELECT ` + ebookLoanColumnsSQL + `
+	FROM ebook_loans
+	INNER JOIN ebooks ON ebooks.id = ebook_loans.ebook_id
+	WHERE ebook_loans.user_id = $1
+	ORDER BY ebook_loans.created_at DESC, ebook_loans.id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loans := []*EbookLoan{}
+	for rows.Next() {
+		var loan EbookLoan
+		err := scanEbookLoan(rows, &loan)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, &loan)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return loans, nil
+}
+
+// GetActiveForUser() returns one of a user's active loans. Loans belonging to other
+// users and loans which have ended are reported as ErrRecordNotFound.
+func (m EbookLoanModel) GetActiveForUser(id, userID int64) (*EbookLoan, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT ` + ebookLoanColumnsSQL + `
+	FROM ebook_loans
+	INNER JOIN ebooks ON ebooks.id = ebook_loans.ebook_id
+	WHERE ebook_loans.id = $1 AND ebook_loans.user_id = $2 AND ` + activeLoanSQL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var loan EbookLoan
+	err := scanEbookLoan(m.DB.QueryRowContext(ctx, query, id, userID), &loan)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &loan, nil
+}
+
+// Return() ends one of a user's active loans early, freeing its license.
+func (m EbookLoanModel) Return(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	UPDATE ebook_loans
+	SET returned_at = NOW()
+	WHERE ebook_loans.id = $1 AND ebook_loans.user_id = $2 AND ` + activeLoanSQL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+var (
+	ErrDuplicateGenre = errors.New("duplicate genre")
+	ErrUnknownGenre   = errors.New("unknown genre")
+	ErrGenreCycle     = errors.New("genre cycle")
+)
+
+// Genre represents a single entry in the controlled genre taxonomy. Genres can be
+// nested under a parent genre (for example "science fiction" under "fiction"), and
+// any number of aliases can point at a genre so that "sci-fi" and "scifi" both
+// resolve to "science fiction".
+type Genre struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	ParentID  *int64    `json:"parent_id,omitempty"`
+	Aliases   []string  `json:"aliases,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+	v.Check(strings.TrimSpace(genre.Name) != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(genre.ParentID == nil || *genre.ParentID > 0, "parent_id", "must be a positive integer")
+	v.Check(genre.ParentID == nil || *genre.ParentID != genre.ID, "parent_id", "must not reference the genre itself")
+	v.Check(len(genre.Aliases) <= 20, "aliases", "must not contain more than 20 aliases")
+	v.Check(validator.Unique(lowerAll(genre.Aliases)), "aliases", "must not contain duplicate values")
+	for _, alias := range genre.Aliases {
+		v.Check(strings.TrimSpace(alias) != "", "aliases", "must not contain empty values")
+		v.Check(len(alias) <= 100, "aliases", "must not contain values more than 100 bytes long")
+		v.Check(!strings.EqualFold(alias, genre.Name), "aliases", "must not contain the genre name")
+	}
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, value := range values {
+		lowered[i] = strings.ToLower(strings.TrimSpace(value))
+	}
+	return lowered
+}
+
+// Define a GenreModel struct type which wraps a sql.DB connection pool.
+type GenreModel struct {
+	DB *sql.DB
+}
+
+// GetAll() returns the whole taxonomy ordered by name. Clients can rebuild the tree
+// from the parent_id fields.
+func (m GenreModel) GetAll() ([]*Genre, error) {
+	query := `
+	SELECT id, created_at, name, parent_id, version,
+		ARRAY(SELECT alias::text FROM genre_aliases WHERE genre_id = genres.id ORDER BY alias)
+	FROM genres
+	ORDER BY name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+	for rows.Next() {
+		var genre Genre
+		err := rows.Scan(
+			&genre.ID,
+			&genre.CreatedAt,
+			&genre.Name,
+			&genre.ParentID,
+			&genre.Version,
+			pq.Array(&genre.Aliases),
+		)
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, &genre)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return genres, nil
+}
+
+func (m GenreModel) Get(id int64) (*Genre, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, name, parent_id, version,
+		ARRAY(SELECT alias::text FROM genre_aliases WHERE genre_id = genres.id ORDER BY alias)
+	FROM genres
+	WHERE id = $1`
+
+	var genre Genre
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&genre.ID,
+		&genre.CreatedAt,
+		&genre.Name,
+		&genre.ParentID,
+		&genre.Version,
+		pq.Array(&genre.Aliases),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &genre, nil
+}
+
+// Insert() creates a new genre along with its aliases. A name or alias which clashes
+// with any existing genre name or alias results in an ErrDuplicateGenre error, and a
+// parent which doesn't exist results in an ErrRecordNotFound error.
+func (m GenreModel) Insert(genre *Genre) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = checkGenreNames(ctx, tx, 0, genre)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO genres (name, parent_id)
+	VALUES ($1, $2)
+	RETURNING id, created_at, version`
+
+	err = tx.QueryRowContext(ctx, query, genre.Name, genre.ParentID).Scan(&genre.ID, &genre.CreatedAt, &genre.Version)
+	if err != nil {
+		return genreWriteError(err)
+	}
+
+	err = setGenreAliases(ctx, tx, genre)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Update() renames or re-parents a genre and replaces its aliases. Because books
+// reference genres by ID, a rename is reflected across every book straight away.
+// Moving a genre underneath one of its own descendants returns ErrGenreCycle.
+func (m GenreModel) Update(genre *Genre) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = checkGenreNames(ctx, tx, genre.ID, genre)
+	if err != nil {
+		return err
+	}
+
+	if genre.ParentID != nil {
+		// Walk up the ancestor chain of the proposed parent. If we reach the genre
+		// being updated then the change would introduce a cycle.
+		query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id FROM genres WHERE id = $1
+			UNION
+			SELECT genres.id, genres.parent_id
+			FROM genres INNER JOIN ancestors ON genres.id = ancestors.parent_id
+		)
+		SELECT EXISTS(SELECT 1 FROM ancestors WHERE id = $2)`
+
+		var cycle bool
+		err = tx.QueryRowContext(ctx, query, *genre.ParentID, genre.ID).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrGenreCycle
+		}
+	}
+
+	query := `
+	UPDATE genres
+	SET name = $1, parent_id = $2, version = version + 1
+	WHERE id = $3 AND version = $4
+	RETURNING version`
+
+	args := []any{genre.Name, genre.ParentID, genre.ID, genre.Version}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&genre.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return genreWriteError(err)
+		}
+	}
+
+	err = setGenreAliases(ctx, tx, genre)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Merge() folds the source genre into the target genre. Every book tagged with the
+// source is re-tagged with the target, child genres are moved under the target, and
+// the source name and aliases become aliases of the target so that existing links
+// and filters keep working. The source genre is then deleted.
+func (m GenreModel) Merge(sourceID, targetID int64) (*Genre, error) {
+	if sourceID < 1 || targetID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock both rows so that concurrent merges or updates can't interleave with us.
+	var sourceName string
+	var targetAncestorOfSource bool
+	query := `
+	WITH RECURSIVE ancestors AS (
+		SELECT id, parent_id FROM genres WHERE id = $2
+		UNION
+		SELECT genres.id, genres.parent_id
+		FROM genres INNER JOIN ancestors ON genres.id = ancestors.parent_id
+	)
+	SELECT genres.name, EXISTS(SELECT 1 FROM ancestors WHERE id = $1)
+	FROM genres
+	WHERE genres.id = $1
+	FOR UPDATE OF genres`
+
+	err = tx.QueryRowContext(ctx, query, sourceID, targetID).Scan(&sourceName, &targetAncestorOfSource)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	// Merging a genre into one of its own descendants would orphan the part of the
+	// tree in between, so we refuse to do it.
+	if targetAncestorOfSource {
+		return nil, ErrGenreCycle
+	}
+
+	var lockedID int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM genres WHERE id = $1 FOR UPDATE`, targetID).Scan(&lockedID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	// Bump the version of every affected book, as its genre list is changing.
+	query = `
+	UPDATE books SET version = version + 1
+	WHERE id IN (SELECT book_id FROM books_genres WHERE genre_id = $1)`
+	_, err = tx.ExecContext(ctx, query, sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := []string{
+		`INSERT INTO books_genres (book_id, genre_id)
+		SELECT book_id, $2 FROM books_genres WHERE genre_id = $1
+		ON CONFLICT DO NOTHING`,
+		`UPDATE genres SET parent_id = $2, version = version + 1 WHERE parent_id = $1`,
+		`UPDATE genre_aliases SET genre_id = $2 WHERE genre_id = $1`,
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement, sourceID, targetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM genres WHERE id = $1`, sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+	INSERT INTO genre_aliases (alias, genre_id)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING`
+	_, err = tx.ExecContext(ctx, query, sourceName, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+	UPDATE genres SET version = version + 1
+	WHERE id = $1
+	RETURNING id, created_at, name, parent_id, version,
+		ARRAY(SELECT alias::text FROM genre_aliases WHERE genre_id = genres.id ORDER BY alias)`
+
+	var target Genre
+	err = tx.QueryRowContext(ctx, query, targetID).Scan(
+		&target.ID,
+		&target.CreatedAt,
+		&target.Name,
+		&target.ParentID,
+		&target.Version,
+		pq.Array(&target.Aliases),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+// checkGenreNames() makes sure that the name and aliases of a genre don't collide
+// with the name or aliases of any other genre, and that the parent genre exists. The
+// excludeID parameter is the ID of the genre being updated (or 0 for a new genre).
+func checkGenreNames(ctx context.Context, tx *sql.Tx, excludeID int64, genre *Genre) error {
+	names := append([]string{genre.Name}, genre.Aliases...)
+
+	query := `
+	SELECT EXISTS(
+		SELECT 1 FROM genres
+		WHERE name = ANY($1::citext[]) AND id <> $2
+	) OR EXISTS(
+		SELECT 1 FROM genre_aliases
+		WHERE alias = ANY($1::citext[]) AND genre_id <> $2
+	)`
+
+	var duplicate bool
+	err := tx.QueryRowContext(ctx, query, pq.Array(names), excludeID).Scan(&duplicate)
+	if err != nil {
+		return err
+	}
+	if duplicate {
+		return ErrDuplicateGenre
+	}
+
+	if genre.ParentID != nil {
+		var exists bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM genres WHERE id = $1)`, *genre.ParentID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrRecordNotFound
+		}
+	}
+	return nil
+}
+
+// setGenreAliases() replaces the aliases of a genre with the ones in genre.Aliases.
+func setGenreAliases(ctx context.Context, tx *sql.Tx, genre *Genre) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM genre_aliases WHERE genre_id = $1`, genre.ID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO genre_aliases (alias, genre_id)
+	SELECT trim(alias), $2 FROM unnest($1::text[]) AS alias`
+
+	_, err = tx.ExecContext(ctx, query, pq.Array(genre.Aliases), genre.ID)
+	if err != nil {
+		return genreWriteError(err)
+	}
+	sort.Strings(genre.Aliases)
+	return nil
+}
+
+// resolveGenres() maps a list of genre names or aliases onto genre IDs, returning
+// the IDs along with the canonical genre names. If any of the values doesn't match a
+// known genre an ErrUnknownGenre error is returned.
+func resolveGenres(ctx context.Context, tx *sql.Tx, names []string) ([]int64, []string, error) {
+	query := `
+	SELECT terms.term, genres.id, genres.name
+	FROM unnest($1::text[]) AS terms(term)
+	INNER JOIN genres ON genres.name = trim(terms.term)::citext
+		OR genres.id = (SELECT genre_id FROM genre_aliases WHERE alias = trim(terms.term)::citext)
+	ORDER BY genres.name`
+
+	rows, err := tx.QueryContext(ctx, query, pq.Array(names))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	matched := make(map[string]bool)
+	seen := make(map[int64]bool)
+	var ids []int64
+	var canonical []string
+	for rows.Next() {
+		var term, name string
+		var id int64
+		err := rows.Scan(&term, &id, &name)
+		if err != nil {
+			return nil, nil, err
+		}
+		matched[term] = true
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+			canonical = append(canonical, name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, name := range names {
+		if !matched[name] {
+			return nil, nil, ErrUnknownGenre
+		}
+	}
+	return ids, canonical, nil
+}
+
+// genreWriteError() translates unique constraint violations on the genres and
+// genre_aliases tables into an ErrDuplicateGenre error.
+func genreWriteError(err error) error {
+	switch {
+	case err.Error() == `pq: duplicate key value violates unique constraint "genres_name_key"`,
+		err.Error() == `pq: duplicate key value violates unique constraint "genre_aliases_pkey"`:
+		return ErrDuplicateGenre
+	default:
+		return err
+	}
+}
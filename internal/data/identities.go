@@ -0,0 +1,168 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateIdentity = errors.New("duplicate identity")
+)
+
+// OIDCLogin is a login through an OpenID Connect provider which is waiting for the user
+// to come back from the provider with the given state.
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+// Define an IdentityModel struct type which wraps a sql.DB connection pool. It links
+// users to their accounts at OpenID Connect providers.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// InsertLogin() stores a login that has been started, clearing out expired ones.
+func (m IdentityModel) InsertLogin(login *OIDCLogin) error {
+	stateHash := sha256.Sum256([]byte(login.State))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM oidc_logins WHERE expiry < NOW()`)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expiry)
+	VALUES ($1, $2, $3, $4)`
+	_, err = m.DB.ExecContext(ctx, query, stateHash[:], login.Nonce, login.CodeVerifier, login.Expiry)
+	return err
+}
+
+// TakeLogin() deletes and returns the login with the given state, so that each state
+// can only be used once. Unknown and expired states give ErrRecordNotFound.
+func (m IdentityModel) TakeLogin(state string) (*OIDCLogin, error) {
+	stateHash := sha256.Sum256([]byte(state))
+	query := `
+	DELETE FROM oidc_logins
+	WHERE state_hash = $1
+	RETURNING nonce, code_verifier, expiry`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	login := OIDCLogin{State: state}
+	err := m.DB.QueryRowContext(ctx, query, stateHash[:]).Scan(&login.Nonce, &login.CodeVerifier, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if !login.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	return &login, nil
+}
+
+// GetUser() returns the user linked to an account at a provider.
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+	SELECT ` + userColumnsSQL + `
+	FROM users
+	INNER JOIN user_identities ON users.id = user_identities.user_id
+	WHERE user_identities.issuer = $1 AND user_identities.subject = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	err := scanUser(m.DB.QueryRowContext(ctx, query, issuer, subject), &user)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// Link() links an existing user to an account at a provider.
+func (m IdentityModel) Link(issuer, subject string, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return linkIdentity(ctx, m.DB, issuer, subject, userID)
+}
+
+func linkIdentity(ctx context.Context, q queryer, issuer, subject string, userID int64) error {
+	query := `
+	INSERT INTO user_identities (issuer, subject, user_id)
+	VALUES ($1, $2, $3)`
+	_, err := q.ExecContext(ctx, query, issuer, subject, userID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_pkey"`:
+			return ErrDuplicateIdentity
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Provision() creates a user for an account at a provider, with the roles that new
+// users get, and links the two.
+func (m IdentityModel) Provision(user *User, issuer, subject string, roles ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO users (name, email, password_hash, activated)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at, version`
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	if len(roles) > 0 {
+		query = `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)`
+		_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(roles))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = linkIdentity(ctx, tx, issuer, subject, user.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,67 @@
+package data
+
+import "strings"
+
+// NormalizeISBN strips the hyphens and spaces from an ISBN and converts a valid
+// ISBN-10 to its ISBN-13 form, so that the same edition always compares equal. Values
+// which aren't a valid ISBN-10 are returned stripped but otherwise unchanged, and will
+// be rejected by ValidISBN.
+func NormalizeISBN(isbn string) string {
+	isbn = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+	if len(isbn) != 10 || !validISBN10(isbn) {
+		return isbn
+	}
+
+	isbn13 := "978" + isbn[:9]
+	return isbn13 + string(isbn13CheckDigit(isbn13))
+}
+
+// ValidISBN returns true if the value is a normalized ISBN-13 with a correct check
+// digit.
+func ValidISBN(isbn string) bool {
+	if len(isbn) != 13 || !allDigits(isbn) {
+		return false
+	}
+	return isbn[12] == isbn13CheckDigit(isbn[:12])
+}
+
+func validISBN10(isbn string) bool {
+	if !allDigits(isbn[:9]) {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(isbn[i]-'0') * (10 - i)
+	}
+	switch last := isbn[9]; {
+	case last == 'X':
+		sum += 10
+	case last >= '0' && last <= '9':
+		sum += int(last - '0')
+	default:
+		return false
+	}
+	return sum%11 == 0
+}
+
+// isbn13CheckDigit calculates the check digit for the first 12 digits of an ISBN-13.
+func isbn13CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(digits[i]-'0') * weight
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
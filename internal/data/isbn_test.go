@@ -0,0 +1,38 @@
+package data
+
+import "testing"
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		name  string
+		isbn  string
+		want  string
+		valid bool
+	}{
+		{"ISBN-10", "0306406152", "9780306406157", true},
+		{"ISBN-10 with hyphens", "0-306-40615-2", "9780306406157", true},
+		{"ISBN-10 with spaces", "0 19 853453 1", "9780198534532", true},
+		{"ISBN-10 with X check digit", "0-8044-2957-X", "9780804429573", true},
+		{"ISBN-10 with lowercase x", "043942089x", "9780439420891", true},
+		{"ISBN-13", "9780306406157", "9780306406157", true},
+		{"ISBN-13 with hyphens", "978-3-16-148410-0", "9783161484100", true},
+		{"ISBN-10 with wrong check digit", "0306406153", "0306406153", false},
+		{"ISBN-10 with X in the middle", "03064X6152", "03064X6152", false},
+		{"ISBN-13 with wrong check digit", "9780306406158", "9780306406158", false},
+		{"ISBN-13 with a letter", "978030640615X", "978030640615X", false},
+		{"too short", "030640615", "030640615", false},
+		{"empty", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeISBN(tt.isbn)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if valid := ValidISBN(got); valid != tt.valid {
+				t.Errorf("got ValidISBN(%q) = %t, want %t", got, valid, tt.valid)
+			}
+		})
+	}
+}
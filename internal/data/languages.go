@@ -0,0 +1,52 @@
+package data
+
+import "github.com/xarafeddine/maktaba/internal/validator"
+
+// languages holds every ISO 639-1 language code. Where PostgreSQL ships a text search
+// configuration for the language the value is the name of that configuration, so that
+// titles are stemmed using the rules for their own language. Languages without a
+// dedicated configuration fall back to the language-agnostic 'simple' configuration.
+var languages = map[string]string{
+	"aa": "", "ab": "", "ae": "", "af": "", "ak": "", "am": "", "an": "", "ar": "arabic",
+	"as": "", "av": "", "ay": "", "az": "", "ba": "", "be": "", "bg": "", "bi": "",
+	"bm": "", "bn": "", "bo": "", "br": "", "bs": "", "ca": "catalan", "ce": "", "ch": "",
+	"co": "", "cr": "", "cs": "", "cu": "", "cv": "", "cy": "", "da": "danish", "de": "german",
+	"dv": "", "dz": "", "ee": "", "el": "greek", "en": "english", "eo": "", "es": "spanish", "et": "",
+	"eu": "basque", "fa": "", "ff": "", "fi": "finnish", "fj": "", "fo": "", "fr": "french", "fy": "",
+	"ga": "irish", "gd": "", "gl": "", "gn": "", "gu": "", "gv": "", "ha": "", "he": "",
+	"hi": "hindi", "ho": "", "hr": "", "ht": "", "hu": "hungarian", "hy": "armenian", "hz": "", "ia": "",
+	"id": "indonesian", "ie": "", "ig": "", "ii": "", "ik": "", "io": "", "is": "", "it": "italian",
+	"iu": "", "ja": "", "jv": "", "ka": "", "kg": "", "ki": "", "kj": "", "kk": "",
+	"kl": "", "km": "", "kn": "", "ko": "", "kr": "", "ks": "", "ku": "", "kv": "",
+	"kw": "", "ky": "", "la": "", "lb": "", "lg": "", "li": "", "ln": "", "lo": "",
+	"lt": "lithuanian", "lu": "", "lv": "", "mg": "", "mh": "", "mi": "", "mk": "", "ml": "",
+	"mn": "", "mr": "", "ms": "", "mt": "", "my": "", "na": "", "nb": "norwegian", "nd": "",
+	"ne": "nepali", "ng": "", "nl": "dutch", "nn": "norwegian", "no": "norwegian", "nr": "", "nv": "", "ny": "",
+	"oc": "", "oj": "", "om": "", "or": "", "os": "", "pa": "", "pi": "", "pl": "",
+	"ps": "", "pt": "portuguese", "qu": "", "rm": "", "rn": "", "ro": "romanian", "ru": "russian", "rw": "",
+	"sa": "", "sc": "", "sd": "", "se": "", "sg": "", "si": "", "sk": "", "sl": "",
+	"sm": "", "sn": "", "so": "", "sq": "", "sr": "serbian", "ss": "", "st": "", "su": "",
+	"sv": "swedish", "sw": "", "ta": "tamil", "te": "", "tg": "", "th": "", "ti": "", "tk": "",
+	"tl": "", "tn": "", "to": "", "tr": "turkish", "ts": "", "tt": "", "tw": "", "ty": "",
+	"ug": "", "uk": "", "ur": "", "uz": "", "ve": "", "vi": "", "vo": "", "wa": "",
+	"wo": "", "xh": "", "yi": "yiddish", "yo": "", "za": "", "zh": "", "zu": "",
+}
+
+// ValidLanguage returns true if the value is a known ISO 639-1 language code.
+func ValidLanguage(code string) bool {
+	_, ok := languages[code]
+	return ok
+}
+
+func ValidateLanguage(v *validator.Validator, code string) {
+	v.Check(ValidLanguage(code), "language", "must be a valid ISO 639-1 language code")
+}
+
+// textSearchConfig returns the name of the PostgreSQL text search configuration to use
+// for the given language code.
+func textSearchConfig(code string) string {
+	if config := languages[code]; config != "" {
+		return config
+	}
+	return "simple"
+}
@@ -11,17 +11,49 @@ var (
 )
 
 type Models struct {
-	Books       BookModel
-	Permissions PermissionModel
-	Tokens      TokenModel // Add a new Tokens field.
-	Users       UserModel
+	APIKeys         APIKeyModel
+	Books           BookModel
+	Branches        BranchModel
+	Copies          CopyModel
+	EbookLoans      EbookLoanModel
+	Ebooks          EbookModel
+	Genres          GenreModel
+	Identities      IdentityModel
+	OAuth           OAuthModel
+	Permissions     PermissionModel
+	Recommendations RecommendationModel
+	Reviews         ReviewModel
+	Roles           RoleModel
+	Shelves         ShelfModel
+	Stocktakes      StocktakeModel
+	Suggestions     SuggestionModel
+	TOTP            TOTPModel
+	Tokens          TokenModel // Add a new Tokens field.
+	Transfers       TransferModel
+	Users           UserModel
 }
 
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Books:       BookModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db}, // Initialize a new TokenModel instance.
-		Users:       UserModel{DB: db},
+		APIKeys:         APIKeyModel{DB: db},
+		Books:           BookModel{DB: db},
+		Branches:        BranchModel{DB: db},
+		Copies:          CopyModel{DB: db},
+		EbookLoans:      EbookLoanModel{DB: db},
+		Ebooks:          EbookModel{DB: db},
+		Genres:          GenreModel{DB: db},
+		Identities:      IdentityModel{DB: db},
+		OAuth:           OAuthModel{DB: db},
+		Permissions:     PermissionModel{DB: db},
+		Recommendations: RecommendationModel{DB: db},
+		Reviews:         ReviewModel{DB: db},
+		Roles:           RoleModel{DB: db},
+		Shelves:         ShelfModel{DB: db},
+		Stocktakes:      StocktakeModel{DB: db},
+		Suggestions:     SuggestionModel{DB: db},
+		TOTP:            TOTPModel{DB: db},
+		Tokens:          TokenModel{DB: db}, // Initialize a new TokenModel instance.
+		Transfers:       TransferModel{DB: db},
+		Users:           UserModel{DB: db},
 	}
 }
@@ -0,0 +1,498 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// CodeVerifierRX matches PKCE code verifiers, which are 43 to 128 unreserved URI
+// characters (RFC 7636, section 4.1).
+var CodeVerifierRX = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// OAuthClient is a third-party app registered to act on behalf of users. Scopes are the
+// permission codes it may ask users for. Confidential clients authenticate with a
+// secret, while public clients, which can't keep one, rely on PKCE alone.
+type OAuthClient struct {
+	ID           string    `json:"client_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UserID       int64     `json:"-"`
+	Name         string    `json:"name"`
+	Confidential bool      `json:"confidential"`
+	SecretHash   []byte    `json:"-"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+}
+
+// OAuthCode is an authorization code, which a client exchanges for an access token.
+type OAuthCode struct {
+	Plaintext     string
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+// OAuthToken is an access token issued to a client. It acts as UserID, but only for
+// the permissions in Scopes.
+type OAuthToken struct {
+	Plaintext string    `json:"access_token"`
+	ClientID  string    `json:"-"`
+	UserID    int64     `json:"-"`
+	Scopes    []string  `json:"-"`
+	Expiry    time.Time `json:"-"`
+}
+
+// OAuthConsent records the scopes a user has given a client.
+type OAuthConsent struct {
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	CreatedAt  time.Time `json:"created_at"`
+	Scopes     []string  `json:"scopes"`
+}
+
+// NewOAuthClient returns a client with a random ID. Confidential clients also get a
+// secret, which is returned in plaintext so that it can be shown once.
+func NewOAuthClient(userID int64, name string, redirectURIs, scopes []string, confidential bool) (*OAuthClient, string, error) {
+	id, err := randomHex(12)
+	if err != nil {
+		return nil, "", err
+	}
+	client := &OAuthClient{
+		ID:           id,
+		UserID:       userID,
+		Name:         name,
+		Confidential: confidential,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+	}
+	if !confidential {
+		return client, "", nil
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	client.SecretHash = hash[:]
+	return client, secret, nil
+}
+
+// MatchesSecret() reports whether secret is the client's secret. It is always false for
+// public clients.
+func (c *OAuthClient) MatchesSecret(secret string) bool {
+	if !c.Confidential {
+		return false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+// VerifyChallenge() checks a PKCE code verifier against the S256 code challenge the
+// code was issued for.
+func (c *OAuthCode) VerifyChallenge(verifier string) bool {
+	hash := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(c.CodeChallenge)) == 1
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 URI")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 URIs")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, uri := range client.RedirectURIs {
+		v.Check(validRedirectURI(uri), "redirect_uris", "must be https URLs, or http URLs on a loopback address, without a fragment")
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+}
+
+// validRedirectURI() reports whether uri can be used as a redirect URI. Plain http is
+// only allowed for apps running on the user's own machine.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		ip := net.ParseIP(u.Hostname())
+		return u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback())
+	default:
+		return false
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Define an OAuthModel struct type which wraps a sql.DB connection pool.
+type OAuthModel struct {
+	DB *sql.DB
+}
+
+func (m OAuthModel) InsertClient(client *OAuthClient) error {
+	query := `
+	INSERT INTO oauth_clients (id, user_id, name, secret_hash, redirect_uris, scopes)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING created_at`
+	args := []any{client.ID, client.UserID, client.Name, client.SecretHash, pq.Array(client.RedirectURIs), pq.Array(client.Scopes)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.CreatedAt)
+}
+
+func (m OAuthModel) GetClient(id string) (*OAuthClient, error) {
+	query := `
+	SELECT id, created_at, user_id, name, secret_hash, redirect_uris, scopes
+	FROM oauth_clients
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	client, err := scanOAuthClient(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// GetClientsForUser() returns the clients a user has registered.
+func (m OAuthModel) GetClientsForUser(userID int64) ([]*OAuthClient, error) {
+	query := `
+	SELECT id, created_at, user_id, name, secret_hash, redirect_uris, scopes
+	FROM oauth_clients
+	WHERE user_id = $1
+	ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func scanOAuthClient(row scanner) (*OAuthClient, error) {
+	var client OAuthClient
+	err := row.Scan(
+		&client.ID,
+		&client.CreatedAt,
+		&client.UserID,
+		&client.Name,
+		&client.SecretHash,
+		pq.Array(&client.RedirectURIs),
+		pq.Array(&client.Scopes),
+	)
+	if err != nil {
+		return nil, err
+	}
+	client.Confidential = client.SecretHash != nil
+	return &client, nil
+}
+
+// DeleteClient() deletes a client registered by a user, along with every consent, code
+// and token given to it.
+func (m OAuthModel) DeleteClient(id string, userID int64) error {
+	query := `
+	DELETE FROM oauth_clients
+	WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetConsent() returns the scopes a user has given a client, or ErrRecordNotFound if
+// they haven't given it any.
+func (m OAuthModel) GetConsent(userID int64, clientID string) (Permissions, error) {
+	query := `
+	SELECT scopes
+	FROM oauth_consents
+	WHERE user_id = $1 AND client_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var scopes []string
+	err := m.DB.QueryRowContext(ctx, query, userID, clientID).Scan(pq.Array(&scopes))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return scopes, nil
+}
+
+// GetConsentsForUser() returns the clients a user has given access to.
+func (m OAuthModel) GetConsentsForUser(userID int64) ([]*OAuthConsent, error) {
+	query := `
+	SELECT oauth_consents.client_id, oauth_clients.name, oauth_consents.created_at, oauth_consents.scopes
+	FROM oauth_consents
+	INNER JOIN oauth_clients ON oauth_clients.id = oauth_consents.client_id
+	WHERE oauth_consents.user_id = $1
+	ORDER BY oauth_consents.created_at, oauth_consents.client_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consents := []*OAuthConsent{}
+	for rows.Next() {
+		var consent OAuthConsent
+		err := rows.Scan(&consent.ClientID, &consent.ClientName, &consent.CreatedAt, pq.Array(&consent.Scopes))
+		if err != nil {
+			return nil, err
+		}
+		consents = append(consents, &consent)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return consents, nil
+}
+
+// DeleteConsent() withdraws a user's consent for a client, revoking the codes and
+// tokens issued to it on their behalf.
+func (m OAuthModel) DeleteConsent(userID int64, clientID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM oauth_consents WHERE user_id = $1 AND client_id = $2`, userID, clientID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM oauth_codes WHERE user_id = $1 AND client_id = $2`, userID, clientID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE user_id = $1 AND client_id = $2`, userID, clientID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Authorize() records a user's consent to the code's scopes, adding to any scopes they
+// gave the client before, and stores the authorization code. The plaintext code is
+// generated and set on code.
+func (m OAuthModel) Authorize(code *OAuthCode) error {
+	plaintext, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	code.Plaintext = plaintext
+	hash := sha256.Sum256([]byte(plaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO oauth_consents (user_id, client_id, scopes)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (user_id, client_id) DO UPDATE
+	SET scopes = ARRAY(SELECT DISTINCT unnest(oauth_consents.scopes || EXCLUDED.scopes))`
+	_, err = tx.ExecContext(ctx, query, code.UserID, code.ClientID, pq.Array(code.Scopes))
+	if err != nil {
+		return err
+	}
+
+	query = `
+	INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := []any{hash[:], code.ClientID, code.UserID, code.RedirectURI, pq.Array(code.Scopes), code.CodeChallenge, code.Expiry}
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExchangeCode() deletes an authorization code issued to a client and returns it, so
+// that each code can only be used once. Unknown and expired codes, and codes issued to
+// other clients, give ErrRecordNotFound.
+func (m OAuthModel) ExchangeCode(plaintext, clientID string) (*OAuthCode, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+	DELETE FROM oauth_codes
+	WHERE hash = $1 AND client_id = $2
+	RETURNING client_id, user_id, redirect_uri, scopes, code_challenge, expiry`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	code := OAuthCode{Plaintext: plaintext}
+	err := m.DB.QueryRowContext(ctx, query, hash[:], clientID).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array(&code.Scopes),
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if !code.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	return &code, nil
+}
+
+// NewToken() creates an access token for a client acting on behalf of a user.
+func (m OAuthModel) NewToken(clientID string, userID int64, scopes []string, ttl time.Duration) (*OAuthToken, error) {
+	// Use the same format as authentication tokens, so that clients can send both in
+	// the same way.
+	generated, err := generateToken(userID, ttl, "")
+	if err != nil {
+		return nil, err
+	}
+	token := &OAuthToken{
+		Plaintext: generated.Plaintext,
+		ClientID:  clientID,
+		UserID:    userID,
+		Scopes:    scopes,
+		Expiry:    generated.Expiry,
+	}
+
+	query := `
+	INSERT INTO oauth_tokens (hash, client_id, user_id, scopes, expiry)
+	VALUES ($1, $2, $3, $4, $5)`
+	args := []any{generated.Hash, token.ClientID, token.UserID, pq.Array(token.Scopes), token.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetForToken() returns the user an access token acts on behalf of, along with the
+// token's client and scopes.
+func (m OAuthModel) GetForToken(plaintext string) (*User, *OAuthToken, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+	SELECT oauth_tokens.client_id, oauth_tokens.scopes, oauth_tokens.expiry, ` + userColumnsSQL + `
+	FROM users
+	INNER JOIN oauth_tokens ON users.id = oauth_tokens.user_id
+	WHERE oauth_tokens.hash = $1
+	AND oauth_tokens.expiry > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	token := OAuthToken{Plaintext: plaintext}
+	err := scanUser(m.DB.QueryRowContext(ctx, query, hash[:], time.Now()), &user,
+		&token.ClientID,
+		pq.Array(&token.Scopes),
+		&token.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	token.UserID = user.ID
+	return &user, &token, nil
+}
@@ -27,16 +27,22 @@ type PermissionModel struct {
 }
 
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
+// Permissions slice: those granted to them individually, along with those of their
+// roles. The code in this method should feel very familiar --- it uses the standard
+// pattern that we've already seen before for retrieving multiple data rows in an SQL
+// query.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 SELECT permissions.code
 FROM permissions
 INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-INNER JOIN users ON users_permissions.user_id = users.id
-WHERE users.id = $1`
+WHERE users_permissions.user_id = $1
+UNION
+SELECT permissions.code
+FROM permissions
+INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+WHERE users_roles.user_id = $1`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -68,3 +74,90 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// The GetAll() method returns every permission code, which are also the scopes that
+// OAuth clients can request.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+SELECT code
+FROM permissions
+ORDER BY code`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// The GetDirectForUser() method returns only the permission codes granted to a user
+// individually, not those of their roles.
+func (m PermissionModel) GetDirectForUser(userID int64) (Permissions, error) {
+	query := `
+SELECT permissions.code
+FROM permissions
+INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+WHERE users_permissions.user_id = $1
+ORDER BY permissions.code`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// The SetForUser() method replaces the permissions granted to a user individually
+// with the given codes. Permissions the user has through their roles are unaffected.
+func (m PermissionModel) SetForUser(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_permissions WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO users_permissions
+	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// userHistorySQL selects the IDs of the books that user $1 has interacted with, by
+// putting them on a shelf, reviewing them or borrowing one of their ebooks.
+const userHistorySQL = `
+	SELECT shelves_books.book_id
+	FROM shelves_books
+	INNER JOIN shelves ON shelves.id = shelves_books.shelf_id
+	WHERE shelves.user_id = $1
+	UNION
+	SELECT book_id FROM reviews WHERE user_id = $1
+	UNION
+	SELECT ebooks.book_id
+	FROM ebook_loans
+	INNER JOIN ebooks ON ebooks.id = ebook_loans.ebook_id
+	WHERE ebook_loans.user_id = $1`
+
+// Define a RecommendationModel struct type which wraps a sql.DB connection pool.
+type RecommendationModel struct {
+	DB *sql.DB
+}
+
+// Recompute() rebuilds the item-to-item similarity table from the shelf, review and
+// ebook loan history of every user. Two books are similar when the same users tend to
+// shelve, review or borrow both of them; the score is the cosine similarity of their
+// user sets, and only the 50 closest books are kept for each book. The whole table is
+// swapped in a single transaction, so readers never see a half-built result. It
+// returns the number of book pairs stored.
+func (m RecommendationModel) Recompute(ctx context.Context) (int64, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM book_similarities`)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+	INSERT INTO book_similarities (book_id, similar_book_id, score)
+	WITH interactions AS (
+		SELECT shelves.user_id, shelves_books.book_id
+		FROM shelves_books
+		INNER JOIN shelves ON shelves.id = shelves_books.shelf_id
+		UNION
+		SELECT user_id, book_id FROM reviews WHERE NOT hidden
+		UNION
+		-- Loans of deleted users are kept without a user, and say nothing about
+		-- what else the borrower read.
+		SELECT ebook_loans.user_id, ebooks.book_id
+		FROM ebook_loans
+		INNER JOIN ebooks ON ebooks.id = ebook_loans.ebook_id
+		WHERE ebook_loans.user_id IS NOT NULL
+	),
+	readers AS (
+		SELECT book_id, count(*) AS total FROM interactions GROUP BY book_id
+	),
+	pairs AS (
+		SELECT a.book_id, b.book_id AS similar_book_id, count(*) AS together
+		FROM interactions AS a
+		INNER JOIN interactions AS b ON b.user_id = a.user_id AND b.book_id <> a.book_id
+		GROUP BY a.book_id, b.book_id
+	),
+	scored AS (
+		SELECT pairs.book_id, pairs.similar_book_id,
+			pairs.together::double precision / sqrt((a.total * b.total)::double precision) AS score
+		FROM pairs
+		INNER JOIN readers AS a ON a.book_id = pairs.book_id
+		INNER JOIN readers AS b ON b.book_id = pairs.similar_book_id
+	),
+	ranked AS (
+		SELECT book_id, similar_book_id, score,
+			row_number() OVER (PARTITION BY book_id ORDER BY score DESC, similar_book_id) AS rank
+		FROM scored
+	)
+	SELECT book_id, similar_book_id, score FROM ranked WHERE rank <= 50`
+
+	result, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	pairs, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return pairs, nil
+}
+
+// SimilarBooks() returns up to limit books that readers of the given book also
+// shelved or reviewed. Books with no co-occurrence data yet fall back to the books
+// sharing the most genres with them.
+func (m RecommendationModel) SimilarBooks(bookID int64, limit int) ([]*Book, error) {
+	query := `
+	SELECT ` + bookColumnsSQL + `
+	FROM book_similarities
+	INNER JOIN books ON books.id = book_similarities.similar_book_id
+	WHERE book_similarities.book_id = $1
+	ORDER BY book_similarities.score DESC, books.id ASC
+	LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	books, err := queryBooks(ctx, m.DB, query, bookID, limit)
+	if err != nil || len(books) > 0 {
+		return books, err
+	}
+
+	query = `
+	SELECT ` + bookColumnsSQL + `
+	FROM books
+	INNER JOIN (
+		SELECT other.book_id, count(*) AS overlap
+		FROM books_genres AS source
+		INNER JOIN books_genres AS other
+			ON other.genre_id = source.genre_id AND other.book_id <> source.book_id
+		WHERE source.book_id = $1
+		GROUP BY other.book_id
+	) AS overlaps ON overlaps.book_id = books.id
+	ORDER BY overlaps.overlap DESC, books.rating DESC, books.id ASC
+	LIMIT $2`
+
+	return queryBooks(ctx, m.DB, query, bookID, limit)
+}
+
+// ForUser() returns up to limit recommended books for a user, by adding up the
+// similarity scores of the books in their history and leaving out the books they
+// already know. Users without enough history get the best rated books in the genres
+// they have read, or simply the best rated books overall.
+func (m RecommendationModel) ForUser(userID int64, limit int) ([]*Book, error) {
+	query := `
+	WITH history AS (` + userHistorySQL + `),
+	candidates AS (
+		SELECT similar_book_id AS book_id, sum(score) AS score
+		FROM book_similarities
+		WHERE book_id IN (SELECT book_id FROM history)
+		AND similar_book_id NOT IN (SELECT book_id FROM history)
+		GROUP BY similar_book_id
+	)
+	SELECT ` + bookColumnsSQL + `
+	FROM candidates
+	INNER JOIN books ON books.id = candidates.book_id
+	ORDER BY candidates.score DESC, books.id ASC
+	LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	books, err := queryBooks(ctx, m.DB, query, userID, limit)
+	if err != nil || len(books) > 0 {
+		return books, err
+	}
+
+	query = `
+	WITH history AS (` + userHistorySQL + `),
+	candidates AS (
+		SELECT books_genres.book_id, count(*) AS overlap
+		FROM books_genres
+		WHERE books_genres.genre_id IN (
+			SELECT genre_id FROM books_genres WHERE book_id IN (SELECT book_id FROM history)
+		)
+		GROUP BY books_genres.book_id
+	)
+	SELECT ` + bookColumnsSQL + `
+	FROM books
+	LEFT JOIN candidates ON candidates.book_id = books.id
+	WHERE books.id NOT IN (SELECT book_id FROM history)
+	ORDER BY COALESCE(candidates.overlap, 0) DESC, books.rating DESC, books.ratings_count DESC, books.id ASC
+	LIMIT $2`
+
+	return queryBooks(ctx, m.DB, query, userID, limit)
+}
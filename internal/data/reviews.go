@@ -0,0 +1,256 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+var (
+	ErrDuplicateReview = errors.New("duplicate review")
+)
+
+// Review holds a single user's rating and review text for a book. Hidden reviews have
+// been taken down by a moderator: they are excluded from listings and don't count
+// towards the book's aggregate rating.
+type Review struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	BookID    int64     `json:"book_id"`
+	UserID    int64     `json:"user_id"`
+	Rating    int32     `json:"rating"`
+	Body      string    `json:"body"`
+	Hidden    bool      `json:"hidden,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Rating != 0, "rating", "must be provided")
+	v.Check(review.Rating >= 1 && review.Rating <= 5, "rating", "must be between 1 and 5")
+	v.Check(strings.TrimSpace(review.Body) != "", "body", "must be provided")
+	v.Check(len(review.Body) <= 10_000, "body", "must not be more than 10000 bytes long")
+}
+
+// Define a ReviewModel struct type which wraps a sql.DB connection pool.
+type ReviewModel struct {
+	DB *sql.DB
+}
+
+// Insert() adds a new review and refreshes the aggregate rating of the book in the
+// same transaction. It returns ErrDuplicateReview if the user has already reviewed the
+// book, and ErrRecordNotFound if the book doesn't exist.
+func (m ReviewModel) Insert(review *Review) error {
+	query := `
+	INSERT INTO reviews (book_id, user_id, rating, body)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at, version`
+
+	args := []any{review.BookID, review.UserID, review.Rating, review.Body}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "reviews_book_id_user_id_key"`:
+			return ErrDuplicateReview
+		case err.Error() == `pq: insert or update on table "reviews" violates foreign key constraint "reviews_book_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	err = refreshBookRating(ctx, tx, review.BookID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m ReviewModel) Get(id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, book_id, user_id, rating, body, hidden, version
+	FROM reviews
+	WHERE id = $1`
+
+	var review Review
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&review.ID,
+		&review.CreatedAt,
+		&review.BookID,
+		&review.UserID,
+		&review.Rating,
+		&review.Body,
+		&review.Hidden,
+		&review.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &review, nil
+}
+
+// GetAllForUser() returns every review a user has written, including hidden ones.
+func (m ReviewModel) GetAllForUser(userID int64) ([]*Review, error) {
+	query := `
+	SELECT id, created_at, book_id, user_id, rating, body, hidden, version
+	FROM reviews
+	WHERE user_id = $1
+	ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []*Review{}
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(
+			&review.ID,
+			&review.CreatedAt,
+			&review.BookID,
+			&review.UserID,
+			&review.Rating,
+			&review.Body,
+			&review.Hidden,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, &review)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+// GetAllForBook() returns the visible reviews for a book, paginated and sorted using
+// the provided filters.
+func (m ReviewModel) GetAllForBook(bookID int64, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, book_id, user_id, rating, body, hidden, version
+	FROM reviews
+	WHERE book_id = $1 AND NOT hidden
+	ORDER BY %s %s, id ASC
+	LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, bookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(
+			&totalRecords,
+			&review.ID,
+			&review.CreatedAt,
+			&review.BookID,
+			&review.UserID,
+			&review.Rating,
+			&review.Body,
+			&review.Hidden,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return reviews, metadata, nil
+}
+
+// SetHidden() hides or restores a review, checking the version number to guard
+// against concurrent moderation, and refreshes the aggregate rating of the book.
+func (m ReviewModel) SetHidden(review *Review) error {
+	query := `
+	UPDATE reviews
+	SET hidden = $1, version = version + 1
+	WHERE id = $2 AND version = $3
+	RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, review.Hidden, review.ID, review.Version).Scan(&review.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = refreshBookRating(ctx, tx, review.BookID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// refreshBookRating() recalculates the average rating and the number of ratings
+// stored against a book from its visible reviews.
+func refreshBookRating(ctx context.Context, tx *sql.Tx, bookID int64) error {
+	query := `
+	UPDATE books
+	SET rating = COALESCE(aggregate.average, 0), ratings_count = aggregate.count
+	FROM (
+		SELECT round(avg(rating), 2) AS average, count(*) AS count
+		FROM reviews
+		WHERE book_id = $1 AND NOT hidden
+	) AS aggregate
+	WHERE books.id = $1`
+
+	_, err := tx.ExecContext(ctx, query, bookID)
+	return err
+}
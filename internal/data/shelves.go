@@ -0,0 +1,387 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// Every user has the three built-in shelves below. A book can only be on one of them
+// at a time, which makes them work as the user's reading status for the book. Users
+// can also create custom shelves, which hold books independently of the status.
+const (
+	ShelfWantToRead = "want-to-read"
+	ShelfReading    = "reading"
+	ShelfRead       = "read"
+)
+
+var (
+	BuiltinShelves = []string{ShelfWantToRead, ShelfReading, ShelfRead}
+
+	ShelfNameRX = regexp.MustCompile("^[a-z0-9]+(?:-[a-z0-9]+)*$")
+
+	ErrDuplicateShelf = errors.New("duplicate shelf")
+)
+
+type Shelf struct {
+	Name      string     `json:"name"`
+	Builtin   bool       `json:"builtin"`
+	BookCount int        `json:"book_count"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// ShelfEntry is a book on one of a user's shelves.
+type ShelfEntry struct {
+	Shelf   string    `json:"shelf"`
+	BookID  int64     `json:"book_id"`
+	Title   string    `json:"title"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// IsBuiltinShelf returns true if the name is one of the built-in shelves.
+func IsBuiltinShelf(name string) bool {
+	return validator.PermittedValue(name, BuiltinShelves...)
+}
+
+// ValidateShelfName checks that a shelf name is a lowercase, hyphen-separated slug so
+// that it can be used directly in a URL.
+func ValidateShelfName(v *validator.Validator, name string) {
+	v.Check(name != "", "shelf", "must be provided")
+	v.Check(len(name) <= 50, "shelf", "must not be more than 50 bytes long")
+	v.Check(validator.Matches(name, ShelfNameRX), "shelf", "must only contain lowercase letters, digits and hyphens")
+}
+
+// Define a ShelfModel struct type which wraps a sql.DB connection pool.
+type ShelfModel struct {
+	DB *sql.DB
+}
+
+// GetAllForUser() returns the built-in shelves followed by the custom shelves of a
+// user, along with the number of books on each of them.
+func (m ShelfModel) GetAllForUser(userID int64) ([]*Shelf, error) {
+	query := `
+	SELECT shelves.name, shelves.builtin, shelves.created_at, count(shelves_books.book_id)
+	FROM shelves
+	LEFT JOIN shelves_books ON shelves_books.shelf_id = shelves.id
+	WHERE shelves.user_id = $1
+	GROUP BY shelves.id
+	ORDER BY shelves.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Built-in shelf rows are only created the first time a book is put on them, so
+	// we start with an empty entry for each and fill in the counts as we go.
+	builtins := make(map[string]*Shelf)
+	shelves := []*Shelf{}
+	for _, name := range BuiltinShelves {
+		shelf := &Shelf{Name: name, Builtin: true}
+		builtins[name] = shelf
+		shelves = append(shelves, shelf)
+	}
+
+	for rows.Next() {
+		var shelf Shelf
+		var createdAt time.Time
+		err := rows.Scan(&shelf.Name, &shelf.Builtin, &createdAt, &shelf.BookCount)
+		if err != nil {
+			return nil, err
+		}
+		if shelf.Builtin {
+			builtins[shelf.Name].BookCount = shelf.BookCount
+			continue
+		}
+		shelf.CreatedAt = &createdAt
+		shelves = append(shelves, &shelf)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return shelves, nil
+}
+
+// Insert() creates a custom shelf for a user. It returns ErrDuplicateShelf if the user
+// already has a shelf with the same name.
+func (m ShelfModel) Insert(userID int64, shelf *Shelf) error {
+	query := `
+	INSERT INTO shelves (user_id, name)
+	VALUES ($1, $2)
+	RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var createdAt time.Time
+	err := m.DB.QueryRowContext(ctx, query, userID, shelf.Name).Scan(&createdAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "shelves_user_id_name_key"`:
+			return ErrDuplicateShelf
+		default:
+			return err
+		}
+	}
+	shelf.CreatedAt = &createdAt
+	return nil
+}
+
+// Delete() removes a custom shelf, along with the record of which books were on it.
+func (m ShelfModel) Delete(userID int64, name string) error {
+	query := `
+	DELETE FROM shelves
+	WHERE user_id = $1 AND name = $2 AND NOT builtin`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetBooks() returns the books on one of the user's shelves, most recently added
+// first by default. An ErrRecordNotFound error is returned for an unknown custom
+// shelf.
+func (m ShelfModel) GetBooks(userID int64, name string, filters Filters) ([]*Book, Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if !IsBuiltinShelf(name) {
+		var exists bool
+		query := `SELECT EXISTS(SELECT 1 FROM shelves WHERE user_id = $1 AND name = $2)`
+		err := m.DB.QueryRowContext(ctx, query, userID, name).Scan(&exists)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if !exists {
+			return nil, Metadata{}, ErrRecordNotFound
+		}
+	}
+
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), books.id, books.created_at, books.title, books.year, books.page_count,
+		%s, books.isbn, books.language, books.rating, books.ratings_count, books.version
+	FROM shelves_books
+	INNER JOIN shelves ON shelves.id = shelves_books.shelf_id
+	INNER JOIN books ON books.id = shelves_books.book_id
+	WHERE shelves.user_id = $1 AND shelves.name = $2
+	ORDER BY %s %s, books.id ASC
+	LIMIT $3 OFFSET $4`, bookGenresSQL, filters.sortColumn(), filters.sortDirection())
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	books := []*Book{}
+	for rows.Next() {
+		var book Book
+		err := rows.Scan(
+			&totalRecords,
+			&book.ID,
+			&book.CreatedAt,
+			&book.Title,
+			&book.Year,
+			&book.PageCount,
+			pq.Array(&book.Genres),
+			&book.ISBN,
+			&book.Language,
+			&book.Rating,
+			&book.RatingsCount,
+			&book.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		books = append(books, &book)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return books, metadata, nil
+}
+
+// AddBook() puts a book on one of the user's shelves. Putting a book on a built-in
+// shelf takes it off the other built-in shelves, so that the book only ever has one
+// reading status. Adding a book which is already on the shelf is a no-op.
+func (m ShelfModel) AddBook(userID int64, name string, bookID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var shelfID int64
+	if IsBuiltinShelf(name) {
+		// Built-in shelf rows are created on first use. The no-op update makes the
+		// RETURNING clause hand back the ID when the row already exists.
+		query := `
+		INSERT INTO shelves (user_id, name, builtin)
+		VALUES ($1, $2, true)
+		ON CONFLICT (user_id, name) DO UPDATE SET builtin = true
+		RETURNING id`
+		err = tx.QueryRowContext(ctx, query, userID, name).Scan(&shelfID)
+		if err != nil {
+			return err
+		}
+
+		query = `
+		DELETE FROM shelves_books
+		USING shelves
+		WHERE shelves.id = shelves_books.shelf_id
+		AND shelves.user_id = $1 AND shelves.builtin AND shelves.id <> $2
+		AND shelves_books.book_id = $3`
+		_, err = tx.ExecContext(ctx, query, userID, shelfID, bookID)
+		if err != nil {
+			return err
+		}
+	} else {
+		query := `SELECT id FROM shelves WHERE user_id = $1 AND name = $2`
+		err = tx.QueryRowContext(ctx, query, userID, name).Scan(&shelfID)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+	}
+
+	query := `
+	INSERT INTO shelves_books (shelf_id, book_id)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING`
+	_, err = tx.ExecContext(ctx, query, shelfID, bookID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "shelves_books" violates foreign key constraint "shelves_books_book_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RemoveBook() takes a book off one of the user's shelves.
+func (m ShelfModel) RemoveBook(userID int64, name string, bookID int64) error {
+	query := `
+	DELETE FROM shelves_books
+	USING shelves
+	WHERE shelves.id = shelves_books.shelf_id
+	AND shelves.user_id = $1 AND shelves.name = $2 AND shelves_books.book_id = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, name, bookID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetForBooks() returns the names of the user's shelves that each of the given books
+// is on, keyed by book ID. Books which aren't on any shelf are left out of the map.
+func (m ShelfModel) GetForBooks(userID int64, bookIDs []int64) (map[int64][]string, error) {
+	query := `
+	SELECT shelves_books.book_id, shelves.name
+	FROM shelves_books
+	INNER JOIN shelves ON shelves.id = shelves_books.shelf_id
+	WHERE shelves.user_id = $1 AND shelves_books.book_id = ANY($2)
+	ORDER BY shelves.builtin DESC, shelves.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, pq.Array(bookIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shelves := make(map[int64][]string)
+	for rows.Next() {
+		var bookID int64
+		var name string
+		err := rows.Scan(&bookID, &name)
+		if err != nil {
+			return nil, err
+		}
+		shelves[bookID] = append(shelves[bookID], name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return shelves, nil
+}
+
+// GetEntriesForUser() returns every book on every one of a user's shelves.
+func (m ShelfModel) GetEntriesForUser(userID int64) ([]*ShelfEntry, error) {
+	query := `
+	SELECT shelves.name, books.id, books.title, shelves_books.added_at
+	FROM shelves_books
+	INNER JOIN shelves ON shelves.id = shelves_books.shelf_id
+	INNER JOIN books ON books.id = shelves_books.book_id
+	WHERE shelves.user_id = $1
+	ORDER BY shelves.name, shelves_books.added_at, books.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*ShelfEntry{}
+	for rows.Next() {
+		var entry ShelfEntry
+		err := rows.Scan(&entry.Shelf, &entry.BookID, &entry.Title, &entry.AddedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,411 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+const (
+	StocktakeOpen   = "open"
+	StocktakeClosed = "closed"
+)
+
+var (
+	ErrOpenStocktake   = errors.New("stocktake already open")
+	ErrStocktakeClosed = errors.New("stocktake closed")
+)
+
+// Stocktake is an audit session covering a branch, or a single shelf location within
+// it. Staff scan the barcodes of the copies they find into the session, and closing it
+// produces a StocktakeReport.
+type Stocktake struct {
+	ID          int64            `json:"id"`
+	CreatedAt   time.Time        `json:"created_at"`
+	BranchID    int64            `json:"branch_id"`
+	Location    string           `json:"location,omitempty"`
+	StartedBy   *int64           `json:"started_by,omitempty"`
+	Status      string           `json:"status"`
+	MarkMissing bool             `json:"mark_missing,omitempty"`
+	ClosedAt    *time.Time       `json:"closed_at,omitempty"`
+	ScanCount   int              `json:"scan_count"`
+	Report      *StocktakeReport `json:"report,omitempty"`
+	Version     int32            `json:"version"`
+}
+
+// StocktakeReport lists the discrepancies found when a stocktake was closed:
+//
+//   - Missing copies should have been in scope but weren't scanned.
+//   - Misplaced copies were scanned, but are recorded at another branch or location.
+//   - Unexpected barcodes were scanned but don't match any copy.
+//   - Found copies were marked as missing, and have turned up again.
+type StocktakeReport struct {
+	Missing    []*StocktakeItem `json:"missing"`
+	Misplaced  []*StocktakeItem `json:"misplaced"`
+	Unexpected []*StocktakeItem `json:"unexpected"`
+	Found      []*StocktakeItem `json:"found"`
+}
+
+type StocktakeItem struct {
+	Barcode string `json:"barcode"`
+	CopyID  *int64 `json:"copy_id,omitempty"`
+	BookID  *int64 `json:"book_id,omitempty"`
+	Title   string `json:"title,omitempty"`
+}
+
+// NormalizeBarcode trims a scanned barcode and upper-cases it, as some scanners send the
+// letters in lower case.
+func NormalizeBarcode(barcode string) string {
+	return strings.ToUpper(strings.TrimSpace(barcode))
+}
+
+func ValidateStocktake(v *validator.Validator, stocktake *Stocktake) {
+	v.Check(stocktake.BranchID != 0, "branch_id", "must be provided")
+	v.Check(stocktake.BranchID > 0, "branch_id", "must be a positive integer")
+	v.Check(len(stocktake.Location) <= 50, "location", "must not be more than 50 bytes long")
+}
+
+func ValidateBarcodes(v *validator.Validator, barcodes []string) {
+	v.Check(len(barcodes) >= 1, "barcodes", "must contain at least 1 barcode")
+	v.Check(len(barcodes) <= 1000, "barcodes", "must not contain more than 1000 barcodes")
+	for _, barcode := range barcodes {
+		v.Check(barcode != "", "barcodes", "must not contain empty values")
+		v.Check(len(barcode) <= 80, "barcodes", "must not contain values more than 80 bytes long")
+	}
+}
+
+// Define a StocktakeModel struct type which wraps a sql.DB connection pool.
+type StocktakeModel struct {
+	DB *sql.DB
+}
+
+// stocktakeColumnsSQL lists the columns scanned by scanStocktake().
+const stocktakeColumnsSQL = `id, created_at, branch_id, location, started_by, status, mark_missing, closed_at,
+	(SELECT count(*) FROM stocktake_scans WHERE stocktake_id = stocktakes.id), version`
+
+func scanStocktake(row scanner, stocktake *Stocktake, extra ...any) error {
+	dest := append(extra,
+		&stocktake.ID,
+		&stocktake.CreatedAt,
+		&stocktake.BranchID,
+		&stocktake.Location,
+		&stocktake.StartedBy,
+		&stocktake.Status,
+		&stocktake.MarkMissing,
+		&stocktake.ClosedAt,
+		&stocktake.ScanCount,
+		&stocktake.Version,
+	)
+	return row.Scan(dest...)
+}
+
+// GetAll() returns the stocktakes of a branch, optionally restricted to a single
+// status. A branchID of 0 returns the stocktakes of every branch. Reports aren't
+// included.
+func (m StocktakeModel) GetAll(branchID int64, status string, filters Filters) ([]*Stocktake, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), %s
+	FROM stocktakes
+	WHERE (branch_id = $1 OR $1 = 0)
+	AND (status = $2 OR $2 = '')
+	ORDER BY %s %s, id ASC
+	LIMIT $3 OFFSET $4`, stocktakeColumnsSQL, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, branchID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	stocktakes := []*Stocktake{}
+	for rows.Next() {
+		var stocktake Stocktake
+		err := scanStocktake(rows, &stocktake, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		stocktakes = append(stocktakes, &stocktake)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return stocktakes, metadata, nil
+}
+
+// Get() returns a stocktake, along with its report if it has been closed.
+func (m StocktakeModel) Get(id int64) (*Stocktake, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + stocktakeColumnsSQL + ` FROM stocktakes WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stocktake Stocktake
+	err := scanStocktake(m.DB.QueryRowContext(ctx, query, id), &stocktake)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if stocktake.Status == StocktakeClosed {
+		stocktake.Report, err = getStocktakeReport(ctx, m.DB, stocktake.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &stocktake, nil
+}
+
+// Insert() opens a new stocktake. It returns ErrUnknownBranch if the branch doesn't
+// exist, and ErrOpenStocktake if a session is already open for the same branch and
+// location.
+func (m StocktakeModel) Insert(stocktake *Stocktake) error {
+	query := `
+	INSERT INTO stocktakes (branch_id, location, started_by)
+	VALUES ($1, $2, $3)
+	RETURNING ` + stocktakeColumnsSQL
+
+	args := []any{stocktake.BranchID, stocktake.Location, stocktake.StartedBy}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := scanStocktake(m.DB.QueryRowContext(ctx, query, args...), stocktake)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "stocktakes_branch_id_location_open_key"`:
+			return ErrOpenStocktake
+		case err.Error() == `pq: insert or update on table "stocktakes" violates foreign key constraint "stocktakes_branch_id_fkey"`:
+			return ErrUnknownBranch
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// AddScans() records scanned barcodes in an open stocktake. Scanning the same barcode
+// twice is harmless. It returns the number of barcodes which hadn't been scanned
+// before, or ErrStocktakeClosed if the session has already been closed.
+func (m StocktakeModel) AddScans(stocktake *Stocktake, barcodes []string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Take a shared lock on the session, so that it can't be closed while we add to it.
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT status FROM stocktakes WHERE id = $1 FOR SHARE`, stocktake.ID).Scan(&status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	if status != StocktakeOpen {
+		return 0, ErrStocktakeClosed
+	}
+
+	normalized := make([]string, len(barcodes))
+	for i, barcode := range barcodes {
+		normalized[i] = NormalizeBarcode(barcode)
+	}
+
+	query := `
+	INSERT INTO stocktake_scans (stocktake_id, barcode)
+	SELECT $1, barcode FROM unnest($2::text[]) AS barcode
+	ON CONFLICT DO NOTHING`
+
+	result, err := tx.ExecContext(ctx, query, stocktake.ID, pq.Array(normalized))
+	if err != nil {
+		return 0, err
+	}
+	added, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM stocktake_scans WHERE stocktake_id = $1`, stocktake.ID).Scan(&stocktake.ScanCount)
+	if err != nil {
+		return 0, err
+	}
+	return int(added), tx.Commit()
+}
+
+// Close() closes an open stocktake and records its report. If markMissing is true,
+// the copies which weren't found are given the missing status. Missing copies which
+// were scanned are made available again at the stocktake's branch either way. It
+// returns ErrStocktakeClosed if the session was already closed, and ErrEditConflict
+// if it was changed concurrently.
+func (m StocktakeModel) Close(stocktake *Stocktake, markMissing bool) error {
+	if stocktake.Status != StocktakeOpen {
+		return ErrStocktakeClosed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE stocktakes
+	SET status = 'closed', mark_missing = $1, closed_at = NOW(), version = version + 1
+	WHERE id = $2 AND version = $3 AND status = 'open'
+	RETURNING ` + stocktakeColumnsSQL
+
+	err = scanStocktake(tx.QueryRowContext(ctx, query, markMissing, stocktake.ID, stocktake.Version), stocktake)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	// The discrepancies are all worked out before any copy is updated. In the queries
+	// below $1 is the stocktake, $2 its branch and $3 its location, with an empty
+	// location covering the whole branch. Each statement is only passed the arguments
+	// it uses, as PostgreSQL rejects any others.
+	id, branchID, location := stocktake.ID, stocktake.BranchID, stocktake.Location
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{`INSERT INTO stocktake_discrepancies (stocktake_id, barcode, copy_id, kind)
+		SELECT $1, copies.barcode, copies.id, 'missing'
+		FROM copies
+		WHERE copies.current_branch_id = $2 AND ($3 = '' OR copies.location = $3)
+		AND copies.status = 'available'
+		AND NOT EXISTS (
+			SELECT 1 FROM stocktake_scans
+			WHERE stocktake_scans.stocktake_id = $1 AND stocktake_scans.barcode = copies.barcode
+		)`, []any{id, branchID, location}},
+		{`INSERT INTO stocktake_discrepancies (stocktake_id, barcode, copy_id, kind)
+		SELECT $1, copies.barcode, copies.id, 'misplaced'
+		FROM stocktake_scans
+		INNER JOIN copies ON copies.barcode = stocktake_scans.barcode
+		WHERE stocktake_scans.stocktake_id = $1
+		AND (copies.current_branch_id IS DISTINCT FROM $2 OR ($3 <> '' AND copies.location <> $3))`, []any{id, branchID, location}},
+		{`INSERT INTO stocktake_discrepancies (stocktake_id, barcode, copy_id, kind)
+		SELECT $1, stocktake_scans.barcode, NULL, 'unexpected'
+		FROM stocktake_scans
+		WHERE stocktake_scans.stocktake_id = $1
+		AND NOT EXISTS (SELECT 1 FROM copies WHERE copies.barcode = stocktake_scans.barcode)`, []any{id}},
+		{`INSERT INTO stocktake_discrepancies (stocktake_id, barcode, copy_id, kind)
+		SELECT $1, copies.barcode, copies.id, 'found'
+		FROM stocktake_scans
+		INNER JOIN copies ON copies.barcode = stocktake_scans.barcode
+		WHERE stocktake_scans.stocktake_id = $1 AND copies.status = 'missing'`, []any{id}},
+		// Found copies are put back where they were scanned, so that the next
+		// stocktake of the location doesn't report them as misplaced.
+		{`UPDATE copies
+		SET status = 'available', current_branch_id = $2,
+			location = CASE WHEN $3 = '' THEN location ELSE $3 END, version = version + 1
+		WHERE id IN (
+			SELECT copy_id FROM stocktake_discrepancies
+			WHERE stocktake_id = $1 AND kind = 'found'
+		)`, []any{id, branchID, location}},
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement.query, statement.args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if markMissing {
+		query := `
+		UPDATE copies
+		SET status = 'missing', version = version + 1
+		WHERE id IN (
+			SELECT copy_id FROM stocktake_discrepancies
+			WHERE stocktake_id = $1 AND kind = 'missing'
+		)`
+
+		_, err = tx.ExecContext(ctx, query, stocktake.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	stocktake.Report, err = getStocktakeReport(ctx, tx, stocktake.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func getStocktakeReport(ctx context.Context, q queryer, stocktakeID int64) (*StocktakeReport, error) {
+	query := `
+	SELECT stocktake_discrepancies.kind, stocktake_discrepancies.barcode, copies.id, books.id, COALESCE(books.title, '')
+	FROM stocktake_discrepancies
+	LEFT JOIN copies ON copies.id = stocktake_discrepancies.copy_id
+	LEFT JOIN books ON books.id = copies.book_id
+	WHERE stocktake_discrepancies.stocktake_id = $1
+	ORDER BY stocktake_discrepancies.barcode`
+
+	rows, err := q.QueryContext(ctx, query, stocktakeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &StocktakeReport{
+		Missing:    []*StocktakeItem{},
+		Misplaced:  []*StocktakeItem{},
+		Unexpected: []*StocktakeItem{},
+		Found:      []*StocktakeItem{},
+	}
+	for rows.Next() {
+		var kind string
+		var item StocktakeItem
+		err := rows.Scan(&kind, &item.Barcode, &item.CopyID, &item.BookID, &item.Title)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "missing":
+			report.Missing = append(report.Missing, &item)
+		case "misplaced":
+			report.Misplaced = append(report.Misplaced, &item)
+		case "unexpected":
+			report.Unexpected = append(report.Unexpected, &item)
+		case "found":
+			report.Found = append(report.Found, &item)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
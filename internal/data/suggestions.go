@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// A suggestion starts out pending. Librarians approve or reject it, order approved
+// suggestions, and finally mark them as received, at which point the book is added to
+// the catalogue.
+const (
+	SuggestionPending  = "pending"
+	SuggestionApproved = "approved"
+	SuggestionRejected = "rejected"
+	SuggestionOrdered  = "ordered"
+	SuggestionReceived = "received"
+)
+
+var (
+	SuggestionStatuses = []string{SuggestionPending, SuggestionApproved, SuggestionRejected, SuggestionOrdered, SuggestionReceived}
+
+	// suggestionTransitions lists the statuses that a suggestion can move to from each
+	// status. Rejected and received suggestions are final.
+	suggestionTransitions = map[string][]string{
+		SuggestionPending:  {SuggestionApproved, SuggestionRejected},
+		SuggestionApproved: {SuggestionOrdered},
+		SuggestionOrdered:  {SuggestionReceived},
+	}
+)
+
+// Suggestion is a patron's request for the library to buy a book.
+type Suggestion struct {
+	ID            int64     `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UserID        int64     `json:"user_id"`
+	Title         string    `json:"title"`
+	Author        string    `json:"author,omitempty"`
+	ISBN          string    `json:"isbn,omitempty"`
+	Year          int32     `json:"year,omitempty"`
+	Note          string    `json:"note,omitempty"`
+	Status        string    `json:"status"`
+	LibrarianNote string    `json:"librarian_note,omitempty"`
+	BookID        *int64    `json:"book_id,omitempty"`
+	Version       int32     `json:"version"`
+}
+
+func ValidateSuggestion(v *validator.Validator, suggestion *Suggestion) {
+	v.Check(strings.TrimSpace(suggestion.Title) != "", "title", "must be provided")
+	v.Check(len(suggestion.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.Check(len(suggestion.Author) <= 500, "author", "must not be more than 500 bytes long")
+	if suggestion.ISBN != "" {
+		v.Check(ValidISBN(suggestion.ISBN), "isbn", "must be a valid ISBN")
+	}
+	v.Check(suggestion.Year >= 0, "year", "must be greater than 0")
+	v.Check(suggestion.Year <= int32(time.Now().Year()), "year", "must not be in the future")
+	v.Check(len(suggestion.Note) <= 2000, "note", "must not be more than 2000 bytes long")
+	v.Check(len(suggestion.LibrarianNote) <= 2000, "librarian_note", "must not be more than 2000 bytes long")
+}
+
+// ValidSuggestionTransition returns true if a suggestion can move from one status to
+// the other.
+func ValidSuggestionTransition(from, to string) bool {
+	return validator.PermittedValue(to, suggestionTransitions[from]...)
+}
+
+// Define a SuggestionModel struct type which wraps a sql.DB connection pool.
+type SuggestionModel struct {
+	DB *sql.DB
+}
+
+// suggestionColumnsSQL lists the columns scanned by scanSuggestion().
+const suggestionColumnsSQL = `id, created_at, user_id, title, author, isbn, year, note, status, librarian_note, book_id, version`
+
+func scanSuggestion(row scanner, suggestion *Suggestion, extra ...any) error {
+	dest := append(extra,
+		&suggestion.ID,
+		&suggestion.CreatedAt,
+		&suggestion.UserID,
+		&suggestion.Title,
+		&suggestion.Author,
+		&suggestion.ISBN,
+		&suggestion.Year,
+		&suggestion.Note,
+		&suggestion.Status,
+		&suggestion.LibrarianNote,
+		&suggestion.BookID,
+		&suggestion.Version,
+	)
+	return row.Scan(dest...)
+}
+
+// GetAll() returns suggestions, optionally restricted to those of a single user (when
+// userID is non-zero) and to a single status.
+func (m SuggestionModel) GetAll(userID int64, status string, filters Filters) ([]*Suggestion, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), %s
+	FROM suggestions
+	WHERE (user_id = $1 OR $1 = 0)
+	AND (status = $2 OR $2 = '')
+	ORDER BY %s %s, id ASC
+	LIMIT $3 OFFSET $4`, suggestionColumnsSQL, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	suggestions := []*Suggestion{}
+	for rows.Next() {
+		var suggestion Suggestion
+		err := scanSuggestion(rows, &suggestion, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return suggestions, metadata, nil
+}
+
+// GetAllForUser() returns every suggestion a user has made, oldest first.
+func (m SuggestionModel) GetAllForUser(userID int64) ([]*Suggestion, error) {
+	query := `
+	SELECT ` + suggestionColumnsSQL + `
+	FROM suggestions
+	WHERE user_id = $1
+	ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*Suggestion{}
+	for rows.Next() {
+		var suggestion Suggestion
+		err := scanSuggestion(rows, &suggestion)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
+
+func (m SuggestionModel) Get(id int64) (*Suggestion, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + suggestionColumnsSQL + ` FROM suggestions WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var suggestion Suggestion
+	err := scanSuggestion(m.DB.QueryRowContext(ctx, query, id), &suggestion)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &suggestion, nil
+}
+
+func (m SuggestionModel) Insert(suggestion *Suggestion) error {
+	query := `
+	INSERT INTO suggestions (user_id, title, author, isbn, year, note)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING ` + suggestionColumnsSQL
+
+	args := []any{suggestion.UserID, suggestion.Title, suggestion.Author, suggestion.ISBN, suggestion.Year, suggestion.Note}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanSuggestion(m.DB.QueryRowContext(ctx, query, args...), suggestion)
+}
+
+// Update() saves the status and librarian note of a suggestion. If book is not nil it
+// is added to the catalogue in the same transaction and linked to the suggestion, so
+// that a received suggestion always has its book. An ErrUnknownGenre error is returned
+// if the book's genres don't exist.
+func (m SuggestionModel) Update(suggestion *Suggestion, book *Book) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if book != nil {
+		err = insertBook(ctx, tx, book)
+		if err != nil {
+			return err
+		}
+		suggestion.BookID = &book.ID
+	}
+
+	query := `
+	UPDATE suggestions
+	SET status = $1, librarian_note = $2, book_id = $3, version = version + 1
+	WHERE id = $4 AND version = $5
+	RETURNING version`
+
+	args := []any{suggestion.Status, suggestion.LibrarianNote, suggestion.BookID, suggestion.ID, suggestion.Version}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&suggestion.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"time"
 
 	"github.com/xarafeddine/maktaba/internal/validator"
@@ -14,6 +16,13 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication" // Include a new authentication scope.
+	ScopeEmailChange    = "email-change"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+)
+
+var (
+	ErrTokenReused = errors.New("refresh token reused")
 )
 
 // Define a Token struct to hold the data for an individual token. This includes the
@@ -25,6 +34,20 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+	Family    string    `json:"-"`
+}
+
+// Session describes a login without revealing its tokens. Current is true for the
+// session the request was made in.
+type Session struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -86,15 +109,186 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewEmailChange() creates a token to send to the new email address a user wants to
+// change to, along with the address. It replaces any change the user had pending, so
+// that only the latest address can be confirmed.
+func (m TokenModel) NewEmailChange(userID int64, email string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, ScopeEmailChange, userID)
+	if err != nil {
+		return nil, err
+	}
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO email_changes (token_hash, email) VALUES ($1, $2)`, token.Hash, email)
+	if err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+// NewRefresh() logs a user in by creating a refresh token in a new family. The family
+// ties together every token issued from this login, so that they can be revoked
+// together. The token records the user agent and IP address of the client it was
+// issued to, so that the user can recognize the session.
+func (m TokenModel) NewRefresh(userID int64, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	familyBytes := make([]byte, 16)
+	_, err := rand.Read(familyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newRefreshToken(userID, hex.EncodeToString(familyBytes), ttl, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewAuthentication() creates an authentication token in a family, replacing the
+// family's previous authentication tokens so that each session holds one at a time.
+func (m TokenModel) NewAuthentication(userID int64, family string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if family != "" {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1 AND scope = $2`, family, ScopeAuthentication)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+// Rotate() exchanges a refresh token for a new one in the same family. The old refresh
+// token is marked as used rather than deleted, so that reuse can be detected.
+// Presenting a used refresh token means that it has leaked, so the whole family is
+// deleted and ErrTokenReused returned along with the used token, whose UserID and
+// Family the caller can use to revoke tokens held elsewhere. Unknown and expired
+// refresh tokens give ErrRecordNotFound.
+func (m TokenModel) Rotate(refreshPlaintext string, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	refreshHash := sha256.Sum256([]byte(refreshPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the refresh token, so that if it is presented twice at the same time the
+	// second request sees it as used.
+	query := `
+SELECT user_id, family, expiry, used_at
+FROM tokens
+WHERE hash = $1 AND scope = $2
+FOR UPDATE`
+
+	used := &Token{Hash: refreshHash[:], Scope: ScopeRefresh}
+	var usedAt *time.Time
+	err = tx.QueryRowContext(ctx, query, refreshHash[:], ScopeRefresh).Scan(&used.UserID, &used.Family, &used.Expiry, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if usedAt != nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, used.Family)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return used, ErrTokenReused
+	}
+	if !used.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, refreshHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newRefreshToken(used.UserID, used.Family, ttl, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+func newRefreshToken(userID int64, family string, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	// Truncate the user agent, as it is supplied by the client.
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.Family = family
+	return token, nil
+}
+
 // Insert() adds the data for a specific token to the tokens table.
 func (m TokenModel) Insert(token *Token) error {
-	query := `
-INSERT INTO tokens (hash, user_id, expiry, scope)
-VALUES ($1, $2, $3, $4)`
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	return insertToken(ctx, m.DB, token)
+}
+
+func insertToken(ctx context.Context, q queryer, token *Token) error {
+	query := `
+INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.Family}
+	_, err := q.ExecContext(ctx, query, args...)
 	return err
 }
 
@@ -108,3 +302,95 @@ WHERE scope = $1 AND user_id = $2`
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// Delete() deletes a single token, given its plaintext, along with the other tokens in
+// its family. Logging out therefore also revokes the session's refresh token.
+func (m TokenModel) Delete(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+DELETE FROM tokens
+WHERE (scope = $1 AND hash = $2)
+OR family IN (SELECT family FROM tokens WHERE scope = $1 AND hash = $2 AND family <> '')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// DeleteFamily() deletes every token in a family.
+func (m TokenModel) DeleteFamily(family string) error {
+	if family == "" {
+		return nil
+	}
+	query := `
+DELETE FROM tokens
+WHERE family = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// GetSessionsForUser() returns a user's sessions, newest first. Each session is the
+// latest refresh token of a login, and the session in currentFamily is marked as the
+// current one.
+func (m TokenModel) GetSessionsForUser(userID int64, currentFamily string) ([]*Session, error) {
+	query := `
+SELECT id, created_at, expiry, user_agent, ip, family = $3
+FROM tokens
+WHERE user_id = $1 AND scope = $2 AND used_at IS NULL AND expiry > NOW()
+ORDER BY created_at DESC, id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeRefresh, currentFamily)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.CreatedAt, &session.Expiry, &session.UserAgent, &session.IP, &session.Current)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSessionForUser() revokes one of a user's sessions by its ID, deleting every
+// token in its family, and returns the family. It returns ErrRecordNotFound if the
+// user has no such session.
+func (m TokenModel) DeleteSessionForUser(id, userID int64) (string, error) {
+	query := `
+DELETE FROM tokens
+WHERE family IN (SELECT family FROM tokens WHERE id = $1 AND user_id = $2 AND scope = $3 AND family <> '')
+RETURNING family`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, id, userID, ScopeRefresh)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	family := ""
+	for rows.Next() {
+		err := rows.Scan(&family)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+	if family == "" {
+		return "", ErrRecordNotFound
+	}
+	return family, nil
+}
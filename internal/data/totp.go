@@ -0,0 +1,265 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+)
+
+// RecoveryCodeCount is the number of recovery codes a user is given.
+const RecoveryCodeCount = 10
+
+// TOTPCredential is a user's authenticator app enrollment. It only protects the
+// account once Confirmed is true.
+type TOTPCredential struct {
+	UserID    int64
+	CreatedAt time.Time
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+}
+
+// GenerateRecoveryCodes returns a fresh set of recovery codes and their hashes. The
+// codes are formatted as two groups of five characters, which are easier to copy down.
+func GenerateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode() hashes a recovery code, ignoring case, spaces and dashes. As the
+// codes are random, a fast hash is enough, in the same way as for tokens.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// Define a TOTPModel struct type which wraps a sql.DB connection pool.
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// Get() returns a user's enrollment, confirmed or not.
+func (m TOTPModel) Get(userID int64) (*TOTPCredential, error) {
+	query := `
+	SELECT user_id, created_at, secret, confirmed, last_step
+	FROM totp_credentials
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var credential TOTPCredential
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&credential.UserID,
+		&credential.CreatedAt,
+		&credential.Secret,
+		&credential.Confirmed,
+		&credential.LastStep,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &credential, nil
+}
+
+// Enabled() reports whether a user has confirmed their enrollment.
+func (m TOTPModel) Enabled(userID int64) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM totp_credentials WHERE user_id = $1 AND confirmed)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var enabled bool
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// Begin() starts an enrollment with a new secret, replacing any unconfirmed one. It
+// returns ErrTwoFactorEnabled if the user has already confirmed an enrollment.
+func (m TOTPModel) Begin(userID int64, secret string) error {
+	query := `
+	INSERT INTO totp_credentials (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET secret = EXCLUDED.secret, created_at = NOW(), last_step = 0
+	WHERE NOT totp_credentials.confirmed`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// Confirm() completes an enrollment once the user has submitted the code for step,
+// and stores the hashes of their recovery codes.
+func (m TOTPModel) Confirm(userID, step int64, recoveryHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE totp_credentials
+	SET confirmed = true, last_step = $2
+	WHERE user_id = $1 AND NOT confirmed`
+
+	result, err := tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, userID, recoveryHashes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseStep() records that the code for step has been used. It returns false if that
+// code, or a later one, has been used before, which stops a code that has been seen
+// over someone's shoulder from being replayed.
+func (m TOTPModel) UseStep(userID, step int64) (bool, error) {
+	query := `
+	UPDATE totp_credentials
+	SET last_step = $2
+	WHERE user_id = $1 AND confirmed AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode() marks one of a user's recovery codes as used. It returns false if
+// the code is wrong or has been used already.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+	UPDATE recovery_codes
+	SET used_at = NOW()
+	WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// ReplaceRecoveryCodes() invalidates a user's recovery codes and stores new ones.
+func (m TOTPModel) ReplaceRecoveryCodes(userID int64, recoveryHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(ctx, tx, userID, recoveryHashes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, q queryer, userID int64, recoveryHashes [][]byte) error {
+	_, err := q.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryHashes {
+		_, err = q.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() turns two-factor authentication off for a user.
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM totp_credentials WHERE user_id = $1`,
+	} {
+		_, err = tx.ExecContext(ctx, query, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
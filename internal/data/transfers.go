@@ -0,0 +1,287 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xarafeddine/maktaba/internal/validator"
+)
+
+// A transfer is requested by the receiving branch, shipped by the branch currently
+// holding the copy (which puts the copy in transit), and finally received. Requested
+// transfers can be cancelled before they are shipped.
+const (
+	TransferRequested = "requested"
+	TransferInTransit = "in_transit"
+	TransferReceived  = "received"
+	TransferCancelled = "cancelled"
+)
+
+var (
+	TransferStatuses = []string{TransferRequested, TransferInTransit, TransferReceived, TransferCancelled}
+
+	// transferTransitions lists the statuses that a transfer can move to from each
+	// status. Received and cancelled transfers are final.
+	transferTransitions = map[string][]string{
+		TransferRequested: {TransferInTransit, TransferCancelled},
+		TransferInTransit: {TransferReceived},
+	}
+
+	ErrOpenTransfer      = errors.New("copy already has an open transfer")
+	ErrCopyUnavailable   = errors.New("copy isn't available")
+	ErrSameBranch        = errors.New("copy is already at the branch")
+	ErrInvalidTransition = errors.New("invalid transfer status transition")
+)
+
+type Transfer struct {
+	ID           int64      `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	CopyID       int64      `json:"copy_id"`
+	FromBranchID int64      `json:"from_branch_id"`
+	ToBranchID   int64      `json:"to_branch_id"`
+	RequestedBy  *int64     `json:"requested_by,omitempty"`
+	Status       string     `json:"status"`
+	ShippedAt    *time.Time `json:"shipped_at,omitempty"`
+	ReceivedAt   *time.Time `json:"received_at,omitempty"`
+	Version      int32      `json:"version"`
+}
+
+// ValidTransferTransition returns true if a transfer can move from one status to the
+// other.
+func ValidTransferTransition(from, to string) bool {
+	return validator.PermittedValue(to, transferTransitions[from]...)
+}
+
+// Define a TransferModel struct type which wraps a sql.DB connection pool.
+type TransferModel struct {
+	DB *sql.DB
+}
+
+// transferColumnsSQL lists the columns scanned by scanTransfer().
+const transferColumnsSQL = `id, created_at, copy_id, from_branch_id, to_branch_id, requested_by, status, shipped_at, received_at, version`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTransfer(row scanner, transfer *Transfer) error {
+	return row.Scan(
+		&transfer.ID,
+		&transfer.CreatedAt,
+		&transfer.CopyID,
+		&transfer.FromBranchID,
+		&transfer.ToBranchID,
+		&transfer.RequestedBy,
+		&transfer.Status,
+		&transfer.ShippedAt,
+		&transfer.ReceivedAt,
+		&transfer.Version,
+	)
+}
+
+// GetAll() returns the transfers into or out of a branch, optionally restricted to a
+// single status. A branchID of 0 returns the transfers of every branch.
+func (m TransferModel) GetAll(branchID int64, status string, filters Filters) ([]*Transfer, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), %s
+	FROM transfers
+	WHERE (from_branch_id = $1 OR to_branch_id = $1 OR $1 = 0)
+	AND (status = $2 OR $2 = '')
+	ORDER BY %s %s, id ASC
+	LIMIT $3 OFFSET $4`, transferColumnsSQL, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, branchID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	transfers := []*Transfer{}
+	for rows.Next() {
+		var transfer Transfer
+		err := rows.Scan(
+			&totalRecords,
+			&transfer.ID,
+			&transfer.CreatedAt,
+			&transfer.CopyID,
+			&transfer.FromBranchID,
+			&transfer.ToBranchID,
+			&transfer.RequestedBy,
+			&transfer.Status,
+			&transfer.ShippedAt,
+			&transfer.ReceivedAt,
+			&transfer.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		transfers = append(transfers, &transfer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return transfers, metadata, nil
+}
+
+func (m TransferModel) Get(id int64) (*Transfer, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + transferColumnsSQL + ` FROM transfers WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var transfer Transfer
+	err := scanTransfer(m.DB.QueryRowContext(ctx, query, id), &transfer)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &transfer, nil
+}
+
+// Insert() requests a transfer of a copy from the branch it is currently at to
+// transfer.ToBranchID. The FromBranchID is filled in from the copy. It returns
+// ErrRecordNotFound if the copy doesn't exist, ErrUnknownBranch if the destination
+// branch doesn't exist, ErrSameBranch if the copy is already there, ErrOpenTransfer if
+// the copy is already being transferred, and ErrCopyUnavailable if it is missing.
+func (m TransferModel) Insert(transfer *Transfer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the copy so that it can't move while we're recording where it moves from.
+	var currentBranchID *int64
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT current_branch_id, status FROM copies WHERE id = $1 FOR UPDATE`, transfer.CopyID).Scan(&currentBranchID, &status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	// A copy without a current branch is already in transit.
+	if currentBranchID == nil {
+		return ErrOpenTransfer
+	}
+	// Missing copies can't be shipped, and receiving them would mark them available
+	// without anyone having found them.
+	if status != CopyAvailable {
+		return ErrCopyUnavailable
+	}
+	if *currentBranchID == transfer.ToBranchID {
+		return ErrSameBranch
+	}
+	transfer.FromBranchID = *currentBranchID
+
+	query := `
+	INSERT INTO transfers (copy_id, from_branch_id, to_branch_id, requested_by)
+	VALUES ($1, $2, $3, $4)
+	RETURNING ` + transferColumnsSQL
+
+	args := []any{transfer.CopyID, transfer.FromBranchID, transfer.ToBranchID, transfer.RequestedBy}
+
+	err = scanTransfer(tx.QueryRowContext(ctx, query, args...), transfer)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "transfers_copy_id_open_key"`:
+			return ErrOpenTransfer
+		case err.Error() == `pq: insert or update on table "transfers" violates foreign key constraint "transfers_to_branch_id_fkey"`:
+			return ErrUnknownBranch
+		default:
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Transition() moves a transfer to a new status and updates the copy to match: shipping
+// a transfer puts the copy in transit, and receiving it makes the copy available at
+// the destination branch. It returns ErrInvalidTransition if the transfer can't move
+// to the status, ErrEditConflict if the transfer was changed concurrently, and
+// ErrCopyUnavailable if the copy went missing before it was shipped.
+func (m TransferModel) Transition(transfer *Transfer, status string) error {
+	if !ValidTransferTransition(transfer.Status, status) {
+		return ErrInvalidTransition
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE transfers
+	SET status = $1,
+		shipped_at = CASE WHEN $1 = 'in_transit' THEN NOW() ELSE shipped_at END,
+		received_at = CASE WHEN $1 = 'received' THEN NOW() ELSE received_at END,
+		version = version + 1
+	WHERE id = $2 AND version = $3
+	RETURNING ` + transferColumnsSQL
+
+	err = scanTransfer(tx.QueryRowContext(ctx, query, status, transfer.ID, transfer.Version), transfer)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	switch status {
+	case TransferInTransit:
+		// A stocktake may have marked the copy missing since the transfer was
+		// requested.
+		var result sql.Result
+		result, err = tx.ExecContext(ctx, `
+		UPDATE copies
+		SET status = 'in_transit', current_branch_id = NULL, version = version + 1
+		WHERE id = $1 AND status = 'available'`, transfer.CopyID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrCopyUnavailable
+		}
+	case TransferReceived:
+		_, err = tx.ExecContext(ctx, `
+		UPDATE copies
+		SET status = 'available', current_branch_id = $2, version = version + 1
+		WHERE id = $1`, transfer.CopyID, transfer.ToBranchID)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
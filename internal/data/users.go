@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/xarafeddine/maktaba/internal/validator"
@@ -28,13 +30,50 @@ func (u *User) IsAnonymous() bool {
 }
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID            int64      `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Name          string     `json:"name"`
+	Email         string     `json:"email"`
+	Password      password   `json:"-"`
+	Activated     bool       `json:"activated"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	BannedAt      *time.Time `json:"banned_at,omitempty"`
+	BanReason     string     `json:"ban_reason,omitempty"`
+	DeleteAt      *time.Time `json:"delete_at,omitempty"`
+	Version       int        `json:"-"`
+}
+
+// IsDeactivated() reports whether an admin has deactivated the user, who then can't
+// activate their account again by themselves.
+func (u *User) IsDeactivated() bool {
+	return u.DeactivatedAt != nil
+}
+
+// IsBanned() reports whether an admin has banned the user.
+func (u *User) IsBanned() bool {
+	return u.BannedAt != nil
+}
+
+// userColumnsSQL lists the columns scanned by scanUser(). The columns are qualified so
+// that the list can be used in queries joining other tables.
+const userColumnsSQL = `users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+	users.deactivated_at, users.banned_at, users.ban_reason, users.delete_at, users.version`
+
+func scanUser(row scanner, user *User, extra ...any) error {
+	dest := append(extra,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeactivatedAt,
+		&user.BannedAt,
+		&user.BanReason,
+		&user.DeleteAt,
+		&user.Version,
+	)
+	return row.Scan(dest...)
 }
 
 // Create a custom password type which is a struct containing the plaintext and hashed
@@ -143,21 +182,13 @@ func (m UserModel) Insert(user *User) error {
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-	SELECT id, created_at, name, email, password_hash, activated, version
+	SELECT ` + userColumnsSQL + `
 	FROM users
 	WHERE email = $1`
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.Name,
-		&user.Email,
-		&user.Password.hash,
-		&user.Activated,
-		&user.Version,
-	)
+	err := scanUser(m.DB.QueryRowContext(ctx, query, email), &user)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -169,6 +200,64 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT ` + userColumnsSQL + `
+	FROM users
+	WHERE id = $1`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := scanUser(m.DB.QueryRowContext(ctx, query, id), &user)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// UserStatus is the part of a user's account which decides whether they may use the
+// tokens they hold, and which can change while they hold them.
+type UserStatus struct {
+	Activated bool
+	BannedAt  *time.Time
+}
+
+// GetStatus() returns whether a user is activated and banned, for checking tokens which
+// carry the rest of the user's details themselves.
+func (m UserModel) GetStatus(id int64) (*UserStatus, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT activated, banned_at
+	FROM users
+	WHERE id = $1`
+	var status UserStatus
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&status.Activated, &status.BannedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &status, nil
+}
+
 // Update the details for a specific user. Notice that we check against the version
 // field to help prevent any race conditions during the request cycle, just like we did
 // when updating a book. And we also check for a violation of the "users_email_key"
@@ -210,7 +299,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Set up the SQL query.
 	query := `
-	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	SELECT ` + userColumnsSQL + `
 	FROM users
 	INNER JOIN tokens
 	ON users.id = tokens.user_id
@@ -227,15 +316,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	defer cancel()
 	// Execute the query, scanning the return values into a User struct. If no matching
 	// record is found we return an ErrRecordNotFound error.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.Name,
-		&user.Email,
-		&user.Password.hash,
-		&user.Activated,
-		&user.Version,
-	)
+	err := scanUser(m.DB.QueryRowContext(ctx, query, args...), &user)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -247,3 +328,360 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	// Return the matching user.
 	return &user, nil
 }
+
+// GetForEmailChangeToken() returns the user an unexpired email change token belongs to,
+// along with the email address they want to change to.
+func (m UserModel) GetForEmailChangeToken(tokenPlaintext string) (*User, string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	SELECT email_changes.email, ` + userColumnsSQL + `
+	FROM users
+	INNER JOIN tokens ON users.id = tokens.user_id
+	INNER JOIN email_changes ON tokens.hash = email_changes.token_hash
+	WHERE tokens.hash = $1
+	AND tokens.scope = $2
+	AND tokens.expiry > $3`
+	args := []any{tokenHash[:], ScopeEmailChange, time.Now()}
+	var user User
+	var email string
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := scanUser(m.DB.QueryRowContext(ctx, query, args...), &user, &email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "", ErrRecordNotFound
+		default:
+			return nil, "", err
+		}
+	}
+	return &user, email, nil
+}
+
+// GetForAuthenticationToken() returns the user an authentication token belongs to,
+// along with the token's family, in a single query.
+func (m UserModel) GetForAuthenticationToken(tokenPlaintext string) (*User, string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	SELECT tokens.family, ` + userColumnsSQL + `
+	FROM users
+	INNER JOIN tokens
+	ON users.id = tokens.user_id
+	WHERE tokens.hash = $1
+	AND tokens.scope = $2
+	AND tokens.expiry > $3`
+	args := []any{tokenHash[:], ScopeAuthentication, time.Now()}
+	var user User
+	var family string
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := scanUser(m.DB.QueryRowContext(ctx, query, args...), &user, &family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "", ErrRecordNotFound
+		default:
+			return nil, "", err
+		}
+	}
+	return &user, family, nil
+}
+
+// likeEscaper escapes the characters which are special in LIKE patterns, so that they
+// match themselves.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// GetAll() returns a page of users, optionally only those who are (or aren't)
+// activated, whose email address contains email, or who have the named role.
+func (m UserModel) GetAll(email string, activated *bool, role string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), `+userColumnsSQL+`
+	FROM users
+	WHERE (users.email ILIKE '%%' || $1::text || '%%' ESCAPE '\' OR $1 = '')
+	AND (users.activated = $2 OR $2::boolean IS NULL)
+	AND ($3::text = '' OR EXISTS (
+		SELECT 1 FROM users_roles
+		INNER JOIN roles ON roles.id = users_roles.role_id
+		WHERE users_roles.user_id = users.id AND roles.name = $3
+	))
+	ORDER BY %s %s, id ASC
+	LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{likeEscaper.Replace(email), activated, role, filters.limit(), filters.offset()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := scanUser(rows, &user, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
+// Deactivate() deactivates a user for good: unlike users who haven't activated their
+// account yet, they can't activate it until RequireActivation() is called.
+func (m UserModel) Deactivate(user *User) error {
+	query := `
+	UPDATE users
+	SET activated = false, deactivated_at = COALESCE(deactivated_at, NOW()), version = version + 1
+	WHERE id = $1
+	RETURNING deactivated_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.DeactivatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	user.Activated = false
+	return nil
+}
+
+// RequireActivation() makes a user activate their account again, which lifts a
+// deactivation.
+func (m UserModel) RequireActivation(user *User) error {
+	query := `
+	UPDATE users
+	SET activated = false, deactivated_at = NULL, version = version + 1
+	WHERE id = $1
+	RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	user.Activated = false
+	user.DeactivatedAt = nil
+	return nil
+}
+
+// Ban() bans a user, recording why. Banning a user who is already banned updates the
+// reason.
+func (m UserModel) Ban(user *User, reason string) error {
+	query := `
+	UPDATE users
+	SET banned_at = COALESCE(banned_at, NOW()), ban_reason = $1, version = version + 1
+	WHERE id = $2
+	RETURNING banned_at, ban_reason, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, reason, user.ID).Scan(&user.BannedAt, &user.BanReason, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Unban() lifts a user's ban.
+func (m UserModel) Unban(user *User) error {
+	query := `
+	UPDATE users
+	SET banned_at = NULL, ban_reason = '', version = version + 1
+	WHERE id = $1
+	RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	user.BannedAt = nil
+	user.BanReason = ""
+	return nil
+}
+
+// ScheduleDeletion() marks a user to be deleted at the given time. Until then the user
+// can cancel the deletion.
+func (m UserModel) ScheduleDeletion(user *User, at time.Time) error {
+	query := `
+	UPDATE users
+	SET delete_at = $1, version = version + 1
+	WHERE id = $2
+	RETURNING delete_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, at, user.ID).Scan(&user.DeleteAt, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// CancelDeletion() unmarks a user who was going to be deleted.
+func (m UserModel) CancelDeletion(user *User) error {
+	query := `
+	UPDATE users
+	SET delete_at = NULL, version = version + 1
+	WHERE id = $1
+	RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	user.DeleteAt = nil
+	return nil
+}
+
+// DeleteScheduled() deletes the users whose deletion is due, returning how many were
+// deleted. Their ebook loans are kept without the user, ending any that are still
+// active, and their reviews are removed from the ratings of the books. Everything else
+// tied to them goes along with the user.
+func (m UserModel) DeleteScheduled(ctx context.Context) (int, error) {
+	rows, err := m.DB.QueryContext(ctx, `SELECT id FROM users WHERE delete_at <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		ok, err := m.deleteScheduled(ctx, id)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// deleteScheduled() deletes a single user, unless they have cancelled the deletion in
+// the meantime.
+func (m UserModel) deleteScheduled(ctx context.Context, id int64) (bool, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// delete_at is NULL if the user cancelled the deletion after the candidates were
+	// read.
+	var due bool
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(delete_at <= NOW(), false) FROM users WHERE id = $1 FOR UPDATE`, id).Scan(&due)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	if !due {
+		return false, nil
+	}
+
+	query := `
+	UPDATE ebook_loans
+	SET returned_at = NOW()
+	WHERE ebook_loans.user_id = $1 AND ` + activeLoanSQL
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `DELETE FROM reviews WHERE user_id = $1 RETURNING book_id`, id)
+	if err != nil {
+		return false, err
+	}
+	var bookIDs []int64
+	for rows.Next() {
+		var bookID int64
+		err := rows.Scan(&bookID)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+		bookIDs = append(bookIDs, bookID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	for _, bookID := range bookIDs {
+		err = refreshBookRating(ctx, tx, bookID)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
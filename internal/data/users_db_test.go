@@ -0,0 +1,101 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestDB() connects to the migrated database in MAKTABA_TEST_DB_DSN, skipping the
+// test if it isn't set. Tests must clean up the rows they create.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("MAKTABA_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("MAKTABA_TEST_DB_DSN isn't set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestUser() inserts a user, who is deleted again when the test ends.
+func newTestUser(t *testing.T, m UserModel) *User {
+	t.Helper()
+
+	user := &User{
+		Name:  "Deletion Test",
+		Email: fmt.Sprintf("deletion-%d@example.com", time.Now().UnixNano()),
+	}
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.DB.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+	return user
+}
+
+func TestDeleteScheduled(t *testing.T) {
+	m := UserModel{DB: newTestDB(t)}
+	ctx := context.Background()
+
+	due := newTestUser(t, m)
+	err := m.ScheduleDeletion(due, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notDue := newTestUser(t, m)
+	err = m.ScheduleDeletion(notDue, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A user who cancels the deletion after DeleteScheduled() has read the candidates
+	// is seen by deleteScheduled() with a NULL delete_at.
+	cancelled := newTestUser(t, m)
+	err = m.ScheduleDeletion(cancelled, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CancelDeletion(cancelled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		user        *User
+		wantDeleted bool
+	}{
+		{"due", due, true},
+		{"not due", notDue, false},
+		{"cancelled in between", cancelled, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted, err := m.deleteScheduled(ctx, tt.user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("got deleted %t, want %t", deleted, tt.wantDeleted)
+			}
+
+			_, err = m.Get(tt.user.ID)
+			if exists := err == nil; exists == tt.wantDeleted {
+				t.Errorf("got user exists %t after deleteScheduled() returned %t", exists, deleted)
+			}
+		})
+	}
+}
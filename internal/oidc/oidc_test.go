@@ -0,0 +1,378 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is a stand-in OpenID Connect provider serving discovery, JWKS and the token
+// endpoint.
+type testIdP struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu          sync.Mutex
+	keys        map[string]crypto.Signer
+	issuer      string
+	idToken     string
+	tokenForm   url.Values
+	jwksFetches int
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{t: t, keys: make(map[string]crypto.Signer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.srv = httptest.NewServer(mux)
+	idp.issuer = idp.srv.URL
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+func (idp *testIdP) provider() *Provider {
+	return New(Config{
+		Issuer:       idp.srv.URL,
+		ClientID:     "maktaba",
+		ClientSecret: "secret",
+		RedirectURL:  "https://maktaba.example/callback",
+		HTTPClient:   idp.srv.Client(),
+	})
+}
+
+func (idp *testIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.issuer,
+		"authorization_endpoint": idp.srv.URL + "/authorize",
+		"token_endpoint":         idp.srv.URL + "/token",
+		"jwks_uri":               idp.srv.URL + "/jwks",
+	})
+}
+
+func (idp *testIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.jwksFetches++
+
+	keys := []map[string]string{}
+	for kid, key := range idp.keys {
+		b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "EC", "kid": kid, "use": "sig", "crv": "P-256",
+				"x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	r.ParseForm()
+	idp.tokenForm = r.PostForm
+
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != "maktaba" || secret != "secret" || r.PostForm.Get("code") != "good-code" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken})
+}
+
+// addKey() generates a signing key, RSA for RS256 and P-256 for ES256.
+func (idp *testIdP) addKey(kid, alg string) {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys[kid] = key
+}
+
+func (idp *testIdP) removeKey(kid string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	delete(idp.keys, kid)
+}
+
+// sign() returns an ID token with the claims, signed with the key kid. A key that the
+// provider doesn't publish can be passed as signer to forge a signature.
+func (idp *testIdP) sign(kid, alg string, claims map[string]any, signer crypto.Signer) string {
+	idp.mu.Lock()
+	if signer == nil {
+		signer = idp.keys[kid]
+	}
+	idp.mu.Unlock()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			idp.t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			idp.t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (idp *testIdP) claims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            idp.srv.URL,
+		"sub":            "user-1",
+		"aud":            "maktaba",
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          "nonce-1",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+func TestVerify(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey("rsa", "RS256")
+	idp.addKey("ec", "ES256")
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(changes map[string]any) map[string]any {
+		claims := idp.claims()
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+				continue
+			}
+			claims[k] = v
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		nonce   string
+		wantErr bool
+	}{
+		{"valid RS256", idp.sign("rsa", "RS256", idp.claims(), nil), "nonce-1", false},
+		{"valid ES256", idp.sign("ec", "ES256", idp.claims(), nil), "nonce-1", false},
+		{"bad signature", idp.sign("rsa", "RS256", idp.claims(), forger), "nonce-1", true},
+		{"algorithm of another key type", idp.sign("rsa", "ES256", idp.claims(), nil), "nonce-1", true},
+		{"alg none", idp.sign("rsa", "none", idp.claims(), nil), "nonce-1", true},
+		{"wrong issuer", idp.sign("rsa", "RS256", with(map[string]any{"iss": "https://evil.example"}), nil), "nonce-1", true},
+		{"wrong audience", idp.sign("rsa", "RS256", with(map[string]any{"aud": "someone-else"}), nil), "nonce-1", true},
+		{"audience list", idp.sign("rsa", "RS256", with(map[string]any{"aud": []string{"maktaba", "other"}, "azp": "maktaba"}), nil), "nonce-1", false},
+		{"wrong authorized party", idp.sign("rsa", "RS256", with(map[string]any{"aud": []string{"maktaba", "other"}, "azp": "other"}), nil), "nonce-1", true},
+		{"missing authorized party", idp.sign("rsa", "RS256", with(map[string]any{"aud": []string{"maktaba", "other"}}), nil), "nonce-1", true},
+		{"wrong nonce", idp.sign("rsa", "RS256", idp.claims(), nil), "nonce-2", true},
+		{"empty nonce", idp.sign("rsa", "RS256", with(map[string]any{"nonce": ""}), nil), "", true},
+		{"expired", idp.sign("rsa", "RS256", with(map[string]any{"exp": time.Now().Add(-2 * time.Minute).Unix()}), nil), "nonce-1", true},
+		{"expired within skew", idp.sign("rsa", "RS256", with(map[string]any{"exp": time.Now().Add(-30 * time.Second).Unix()}), nil), "nonce-1", false},
+		{"issued in the future", idp.sign("rsa", "RS256", with(map[string]any{"iat": time.Now().Add(5 * time.Minute).Unix()}), nil), "nonce-1", true},
+		{"missing subject", idp.sign("rsa", "RS256", with(map[string]any{"sub": nil}), nil), "nonce-1", true},
+		{"malformed", "not-a-token", "nonce-1", true},
+	}
+
+	p := idp.provider()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.Verify(context.Background(), tt.token, tt.nonce)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Fatalf("got error %v, want ErrInvalidIDToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Claims{Issuer: idp.srv.URL, Subject: "user-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+			if *claims != want {
+				t.Errorf("got claims %+v, want %+v", *claims, want)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey("old", "RS256")
+	p := idp.provider()
+
+	_, err := p.Verify(context.Background(), idp.sign("old", "RS256", idp.claims(), nil), "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Verify(context.Background(), idp.sign("old", "RS256", idp.claims(), nil), "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idp.jwksFetches != 1 {
+		t.Fatalf("got %d JWKS fetches for a known key, want 1", idp.jwksFetches)
+	}
+
+	// The provider rotates to a new key, which we don't know yet.
+	idp.addKey("new", "ES256")
+	idp.removeKey("old")
+	_, err = p.Verify(context.Background(), idp.sign("new", "ES256", idp.claims(), nil), "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idp.jwksFetches != 2 {
+		t.Fatalf("got %d JWKS fetches after rotation, want 2", idp.jwksFetches)
+	}
+
+	_, err = p.Verify(context.Background(), idp.sign("new", "ES256", idp.claims(), nil), "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idp.jwksFetches != 2 {
+		t.Fatalf("got %d JWKS fetches for a known key, want 2", idp.jwksFetches)
+	}
+
+	// A key the provider doesn't publish is refused after fetching the keys again.
+	stranger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Verify(context.Background(), idp.sign("unknown", "RS256", idp.claims(), stranger), "nonce-1")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("got error %v for an unknown kid, want ErrInvalidIDToken", err)
+	}
+	if idp.jwksFetches != 3 {
+		t.Fatalf("got %d JWKS fetches for an unknown kid, want 3", idp.jwksFetches)
+	}
+
+	// So is the key that was rotated out.
+	_, err = p.Verify(context.Background(), idp.sign("old", "RS256", idp.claims(), stranger), "nonce-1")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("got error %v for a rotated out key, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey("rsa", "RS256")
+	idp.idToken = idp.sign("rsa", "RS256", idp.claims(), nil)
+	p := idp.provider()
+
+	token, err := p.Exchange(context.Background(), "good-code", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != idp.idToken {
+		t.Errorf("got ID token %q, want %q", token, idp.idToken)
+	}
+	for key, want := range map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          "good-code",
+		"code_verifier": "verifier",
+		"redirect_uri":  "https://maktaba.example/callback",
+	} {
+		if got := idp.tokenForm.Get(key); got != want {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+
+	_, err = p.Exchange(context.Background(), "bad-code", "verifier")
+	if !errors.Is(err, ErrExchange) {
+		t.Fatalf("got error %v for a bad code, want ErrExchange", err)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := newTestIdP(t)
+	p := New(Config{
+		Issuer:      idp.srv.URL,
+		ClientID:    "maktaba",
+		RedirectURL: "https://maktaba.example/callback",
+		Scopes:      []string{"email", "profile"},
+		HTTPClient:  idp.srv.Client(),
+	})
+
+	raw, err := p.AuthCodeURL(context.Background(), "state-1", "nonce-1", CodeChallenge("verifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != idp.srv.URL+"/authorize" {
+		t.Errorf("got endpoint %q, want %q", got, idp.srv.URL+"/authorize")
+	}
+	for key, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             "maktaba",
+		"redirect_uri":          "https://maktaba.example/callback",
+		"scope":                 "openid email profile",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        CodeChallenge("verifier"),
+		"code_challenge_method": "S256",
+	} {
+		if got := u.Query().Get(key); got != want {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.issuer = "https://other.example"
+
+	_, err := idp.provider().AuthCodeURL(context.Background(), "state", "nonce", "challenge")
+	if err == nil {
+		t.Fatal("got no error for a discovery document with another issuer")
+	}
+}
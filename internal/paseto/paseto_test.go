@@ -0,0 +1,110 @@
+package paseto
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The key and tokens of the official v4.public test vectors 4-S-1 and 4-S-2. Vector
+// 4-S-3 uses an implicit assertion, which we don't support.
+const (
+	vectorSecretKey = "b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a3774" +
+		"1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2"
+	vectorMessage = `{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`
+	vectorFooter  = `{"kid":"zVhMiPBP9fRf2snEcT7gFTioeA9COcNy9DfgL1W60haN"}`
+	vectorToken1  = "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9" +
+		"bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA"
+	vectorToken2 = "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9" +
+		"v3Jt8mx_TdM2ceTGoqwrh4yDFn0XsHvvV_D0DtwQxVrJEBMl0F2caAdgnpKlt4p7xBnx1HcO-SPo8FPp214HDw" +
+		".eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"
+)
+
+func vectorKey(t *testing.T) ed25519.PrivateKey {
+	key, err := hex.DecodeString(vectorSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.PrivateKey(key)
+}
+
+func TestVectors(t *testing.T) {
+	key := vectorKey(t)
+
+	tests := []struct {
+		name   string
+		footer string
+		token  string
+	}{
+		{"4-S-1", "", vectorToken1},
+		{"4-S-2", vectorFooter, vectorToken2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := Sign(key, []byte(vectorMessage), []byte(tt.footer))
+			if token != tt.token {
+				t.Errorf("got token %q, want %q", token, tt.token)
+			}
+
+			message, err := Verify(key.Public().(ed25519.PublicKey), tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(message) != vectorMessage {
+				t.Errorf("got message %q, want %q", message, vectorMessage)
+			}
+
+			footer, err := Footer(tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(footer) != tt.footer {
+				t.Errorf("got footer %q, want %q", footer, tt.footer)
+			}
+		})
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	key := vectorKey(t)
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public := key.Public().(ed25519.PublicKey)
+	withoutFooter := vectorToken2[:strings.LastIndex(vectorToken2, ".")]
+	// Flip a bit of the message, which is followed by the 86 characters of the
+	// signature.
+	tampered := []byte(withoutFooter)
+	tampered[len(tampered)-90] ^= 1
+
+	tests := []struct {
+		name  string
+		key   ed25519.PublicKey
+		token string
+	}{
+		{"wrong key", otherKey.Public().(ed25519.PublicKey), vectorToken1},
+		{"tampered message", public, string(tampered)},
+		{"tampered footer", public, withoutFooter + "." + encoding.EncodeToString([]byte(`{"kid":"other"}`))},
+		{"footer added", public, vectorToken1 + "." + encoding.EncodeToString([]byte(vectorFooter))},
+		{"footer removed", public, withoutFooter},
+		{"other version", public, strings.Replace(vectorToken1, "v4.", "v3.", 1)},
+		{"local purpose", public, strings.Replace(vectorToken1, ".public.", ".local.", 1)},
+		{"too short", public, "v4.public.AAAA"},
+		{"bad encoding", public, "v4.public.!!!!"},
+		{"empty", public, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Verify(tt.key, tt.token)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
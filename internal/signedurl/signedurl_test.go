@@ -0,0 +1,85 @@
+package signedurl
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	signer := New([]byte("secret"))
+	now := time.Unix(1700000000, 0)
+	expires := now.Add(time.Hour)
+
+	signed := signer.Sign("/v1/ebooks/1/download", url.Values{"loan": {"7"}}, expires)
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with() returns the signed query with a parameter changed, or removed if value is
+	// empty.
+	with := func(key, value string) url.Values {
+		query := u.Query()
+		if value == "" {
+			query.Del(key)
+		} else {
+			query.Set(key, value)
+		}
+		return query
+	}
+
+	tests := []struct {
+		name    string
+		signer  Signer
+		path    string
+		query   url.Values
+		now     time.Time
+		wantErr error
+	}{
+		{"valid", signer, u.Path, u.Query(), now, nil},
+		{"just before expiry", signer, u.Path, u.Query(), expires.Add(-time.Second), nil},
+		{"at expiry", signer, u.Path, u.Query(), expires, ErrExpired},
+		{"expired", signer, u.Path, u.Query(), expires.Add(time.Hour), ErrExpired},
+		{"other path", signer, "/v1/ebooks/2/download", u.Query(), now, ErrInvalidSignature},
+		{"changed parameter", signer, u.Path, with("loan", "8"), now, ErrInvalidSignature},
+		{"added parameter", signer, u.Path, with("download", "1"), now, ErrInvalidSignature},
+		{"removed parameter", signer, u.Path, with("loan", ""), now, ErrInvalidSignature},
+		{"extended expiry", signer, u.Path, with("exp", "1800000000"), now, ErrInvalidSignature},
+		{"tampered signature", signer, u.Path, with("sig", "00"+u.Query().Get("sig")[2:]), now, ErrInvalidSignature},
+		{"missing signature", signer, u.Path, with("sig", ""), now, ErrInvalidSignature},
+		{"malformed signature", signer, u.Path, with("sig", "not-hex"), now, ErrInvalidSignature},
+		{"other secret", New([]byte("other")), u.Path, u.Query(), now, ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.signer.Verify(tt.path, tt.query, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignKeepsParams(t *testing.T) {
+	signer := New([]byte("secret"))
+	params := url.Values{"loan": {"7"}}
+
+	signed := signer.Sign("/download", params, time.Unix(1700000000, 0))
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := u.Query().Get("loan"); got != "7" {
+		t.Errorf("got loan %q, want %q", got, "7")
+	}
+	if got := u.Query().Get("exp"); got != "1700000000" {
+		t.Errorf("got exp %q, want %q", got, "1700000000")
+	}
+	if _, ok := params["sig"]; ok {
+		t.Error("Sign modified the params passed to it")
+	}
+}
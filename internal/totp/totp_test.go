@@ -0,0 +1,133 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret of the RFC 4226 and RFC 6238 test vectors,
+// "12345678901234567890", base32-encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC4226(t *testing.T) {
+	// RFC 4226, appendix D: the HOTP values for counters 0 to 9.
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for counter, code := range want {
+		got, err := Code(rfcSecret, int64(counter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != code {
+			t.Errorf("counter %d: got %q, want %q", counter, got, code)
+		}
+	}
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	// RFC 6238, appendix B: the SHA-1 values, which are 8 digits long there, so we
+	// only compare the last 6.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		got, err := Code(rfcSecret, Step(now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.code[len(tt.code)-Digits:]; got != want {
+			t.Errorf("time %d: got %q, want %q", tt.unix, got, want)
+		}
+
+		step, ok := Validate(rfcSecret, got, now)
+		if !ok || step != Step(now) {
+			t.Errorf("time %d: got step %d and %t from Validate, want %d and true", tt.unix, step, ok, Step(now))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name   string
+		offset int64
+		valid  bool
+	}{
+		{"two periods early", -2, false},
+		{"one period early", -1, true},
+		{"current period", 0, true},
+		{"one period late", 1, true},
+		{"two periods late", 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, current+tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			step, ok := Validate(rfcSecret, code, now)
+			if ok != tt.valid {
+				t.Fatalf("got %t, want %t", ok, tt.valid)
+			}
+			if ok && step != current+tt.offset {
+				t.Errorf("got step %d, want %d", step, current+tt.offset)
+			}
+		})
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		valid  bool
+	}{
+		{"spaces", rfcSecret, "287 082", true},
+		{"lowercase secret", strings.ToLower(rfcSecret), "287082", true},
+		{"wrong code", rfcSecret, "287083", false},
+		{"too short", rfcSecret, "28708", false},
+		{"too long", rfcSecret, "2870820", false},
+		{"empty", rfcSecret, "", false},
+		{"invalid secret", "not base32!", "287082", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := Validate(tt.secret, tt.code, now)
+			if ok != tt.valid {
+				t.Errorf("got %t, want %t", ok, tt.valid)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 20 {
+		t.Errorf("got a %d byte secret, want 20", len(key))
+	}
+}
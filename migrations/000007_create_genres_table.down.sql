@@ -0,0 +1,15 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS genres text [] NOT NULL DEFAULT '{}';
+UPDATE books
+SET genres = ARRAY(
+        SELECT genres.name::text
+        FROM books_genres
+            INNER JOIN genres ON genres.id = books_genres.genre_id
+        WHERE books_genres.book_id = books.id
+        ORDER BY genres.name
+    );
+ALTER TABLE books ALTER COLUMN genres DROP DEFAULT;
+CREATE INDEX IF NOT EXISTS books_genres_idx ON books USING GIN (genres);
+DELETE FROM permissions WHERE code = 'genres:write';
+DROP TABLE IF EXISTS books_genres;
+DROP TABLE IF EXISTS genre_aliases;
+DROP TABLE IF EXISTS genres;
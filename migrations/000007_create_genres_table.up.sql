@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS genres (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name citext UNIQUE NOT NULL,
+    parent_id bigint REFERENCES genres ON DELETE SET NULL,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT genres_parent_check CHECK (parent_id <> id)
+);
+CREATE TABLE IF NOT EXISTS genre_aliases (
+    alias citext PRIMARY KEY,
+    genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS books_genres (
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE,
+    PRIMARY KEY (book_id, genre_id)
+);
+CREATE INDEX IF NOT EXISTS genres_parent_id_idx ON genres (parent_id);
+CREATE INDEX IF NOT EXISTS books_genres_genre_id_idx ON books_genres (genre_id);
+-- Move the existing free-text genres into the new tables. Values which only differ
+-- by case or surrounding whitespace collapse into a single genre.
+INSERT INTO genres (name)
+SELECT DISTINCT trim(g.name)::citext
+FROM books
+    CROSS JOIN LATERAL unnest(books.genres) AS g(name)
+WHERE trim(g.name) <> ''
+ON CONFLICT DO NOTHING;
+INSERT INTO books_genres (book_id, genre_id)
+SELECT DISTINCT books.id, genres.id
+FROM books
+    CROSS JOIN LATERAL unnest(books.genres) AS g(name)
+    INNER JOIN genres ON genres.name = trim(g.name)::citext;
+ALTER TABLE books DROP CONSTRAINT IF EXISTS genres_length_check;
+DROP INDEX IF EXISTS books_genres_idx;
+ALTER TABLE books DROP COLUMN IF EXISTS genres;
+-- Add the permission for managing the genre taxonomy.
+INSERT INTO permissions (code)
+VALUES ('genres:write');
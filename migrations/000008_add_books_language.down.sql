@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS books_language_idx;
+DROP INDEX IF EXISTS books_title_idx;
+ALTER TABLE books DROP COLUMN IF EXISTS search_config;
+ALTER TABLE books DROP COLUMN IF EXISTS language;
+CREATE INDEX IF NOT EXISTS books_title_idx ON books USING GIN (to_tsvector('simple', title));
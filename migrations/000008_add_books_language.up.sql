@@ -0,0 +1,7 @@
+ALTER TABLE books
+ADD COLUMN IF NOT EXISTS language text NOT NULL DEFAULT '';
+ALTER TABLE books
+ADD COLUMN IF NOT EXISTS search_config regconfig NOT NULL DEFAULT 'simple';
+DROP INDEX IF EXISTS books_title_idx;
+CREATE INDEX IF NOT EXISTS books_title_idx ON books USING GIN (to_tsvector(search_config, title));
+CREATE INDEX IF NOT EXISTS books_language_idx ON books (language);
@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code = 'reviews:moderate';
+ALTER TABLE books DROP COLUMN IF EXISTS ratings_count;
+ALTER TABLE books DROP COLUMN IF EXISTS rating;
+DROP TABLE IF EXISTS reviews;
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS reviews (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    rating smallint NOT NULL,
+    body text NOT NULL,
+    hidden bool NOT NULL DEFAULT false,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT reviews_rating_check CHECK (rating BETWEEN 1 AND 5),
+    CONSTRAINT reviews_book_id_user_id_key UNIQUE (book_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS reviews_user_id_idx ON reviews (user_id);
+-- Keep the aggregate rating on the books table so that it can be returned and sorted
+-- on without touching the reviews table.
+ALTER TABLE books
+ADD COLUMN IF NOT EXISTS rating numeric(3, 2) NOT NULL DEFAULT 0;
+ALTER TABLE books
+ADD COLUMN IF NOT EXISTS ratings_count integer NOT NULL DEFAULT 0;
+INSERT INTO permissions (code)
+VALUES ('reviews:moderate');
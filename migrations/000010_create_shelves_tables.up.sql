@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS shelves (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    builtin bool NOT NULL DEFAULT false,
+    CONSTRAINT shelves_user_id_name_key UNIQUE (user_id, name)
+);
+CREATE TABLE IF NOT EXISTS shelves_books (
+    shelf_id bigint NOT NULL REFERENCES shelves ON DELETE CASCADE,
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    added_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (shelf_id, book_id)
+);
+CREATE INDEX IF NOT EXISTS shelves_books_book_id_idx ON shelves_books (book_id);
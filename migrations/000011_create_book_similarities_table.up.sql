@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS book_similarities (
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    similar_book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    score double precision NOT NULL,
+    computed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (book_id, similar_book_id)
+);
+CREATE INDEX IF NOT EXISTS book_similarities_similar_book_id_idx ON book_similarities (similar_book_id);
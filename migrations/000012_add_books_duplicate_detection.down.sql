@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS book_redirects;
+DROP INDEX IF EXISTS books_title_normalized_idx;
+DROP INDEX IF EXISTS books_isbn_idx;
+ALTER TABLE books DROP COLUMN IF EXISTS title_normalized;
+ALTER TABLE books DROP COLUMN IF EXISTS isbn;
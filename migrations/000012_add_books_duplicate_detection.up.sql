@@ -0,0 +1,19 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+ALTER TABLE books
+ADD COLUMN IF NOT EXISTS isbn text NOT NULL DEFAULT '';
+-- Titles are compared with punctuation stripped and case folded, so that "The Hobbit"
+-- and "the hobbit." are treated as the same title.
+ALTER TABLE books
+ADD COLUMN IF NOT EXISTS title_normalized text GENERATED ALWAYS AS (
+        trim(lower(regexp_replace(title, '[^[:alnum:]]+', ' ', 'g')))
+    ) STORED;
+CREATE INDEX IF NOT EXISTS books_isbn_idx ON books (isbn) WHERE isbn <> '';
+CREATE INDEX IF NOT EXISTS books_title_normalized_idx ON books USING GIN (title_normalized gin_trgm_ops);
+-- When a duplicate book is merged into another one, a redirect from the old ID to the
+-- surviving book is kept so that existing links continue to work.
+CREATE TABLE IF NOT EXISTS book_redirects (
+    old_id bigint PRIMARY KEY,
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS book_redirects_book_id_idx ON book_redirects (book_id);
@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code IN ('branches:write', 'copies:write');
+DROP TABLE IF EXISTS transfers;
+DROP TABLE IF EXISTS copies;
+DROP TABLE IF EXISTS branches;
@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS branches (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name citext UNIQUE NOT NULL,
+    address text NOT NULL DEFAULT '',
+    version integer NOT NULL DEFAULT 1
+);
+-- Each physical copy of a book belongs to a home branch. The current branch is where
+-- the copy is right now, and is NULL while the copy is in transit between branches.
+CREATE TABLE IF NOT EXISTS copies (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    home_branch_id bigint NOT NULL REFERENCES branches,
+    current_branch_id bigint REFERENCES branches,
+    status text NOT NULL DEFAULT 'available',
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT copies_status_check CHECK (status IN ('available', 'in_transit')),
+    CONSTRAINT copies_current_branch_check CHECK ((status = 'in_transit') = (current_branch_id IS NULL))
+);
+CREATE INDEX IF NOT EXISTS copies_book_id_idx ON copies (book_id);
+CREATE INDEX IF NOT EXISTS copies_current_branch_id_idx ON copies (current_branch_id, status);
+CREATE TABLE IF NOT EXISTS transfers (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    copy_id bigint NOT NULL REFERENCES copies ON DELETE CASCADE,
+    from_branch_id bigint NOT NULL REFERENCES branches,
+    to_branch_id bigint NOT NULL REFERENCES branches,
+    requested_by bigint REFERENCES users ON DELETE SET NULL,
+    status text NOT NULL DEFAULT 'requested',
+    shipped_at timestamp(0) with time zone,
+    received_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT transfers_status_check CHECK (status IN ('requested', 'in_transit', 'received', 'cancelled')),
+    CONSTRAINT transfers_branches_check CHECK (from_branch_id <> to_branch_id)
+);
+-- A copy can only have one open transfer at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS transfers_copy_id_open_key ON transfers (copy_id)
+WHERE status IN ('requested', 'in_transit');
+CREATE INDEX IF NOT EXISTS transfers_to_branch_id_idx ON transfers (to_branch_id, status);
+CREATE INDEX IF NOT EXISTS transfers_from_branch_id_idx ON transfers (from_branch_id, status);
+-- Add the permissions for managing branches, and for managing copies and transfers.
+INSERT INTO permissions (code)
+VALUES ('branches:write'),
+    ('copies:write');
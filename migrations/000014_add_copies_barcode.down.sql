@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS copies_barcode_key;
+ALTER TABLE copies DROP COLUMN IF EXISTS barcode;
@@ -0,0 +1,6 @@
+-- Every copy gets a barcode derived from its ID, such as C000000042, which is printed
+-- on its label and scanned at the desk and during stocktakes. IDs are padded to nine
+-- digits, and longer IDs are used in full so that barcodes stay unique.
+ALTER TABLE copies
+ADD COLUMN IF NOT EXISTS barcode text GENERATED ALWAYS AS ('C' || lpad(id::text, greatest(9, length(id::text)), '0')) STORED;
+CREATE UNIQUE INDEX IF NOT EXISTS copies_barcode_key ON copies (barcode);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS stocktake_discrepancies;
+DROP TABLE IF EXISTS stocktake_scans;
+DROP TABLE IF EXISTS stocktakes;
+UPDATE copies SET status = 'available' WHERE status = 'missing';
+ALTER TABLE copies DROP CONSTRAINT IF EXISTS copies_status_check;
+ALTER TABLE copies
+ADD CONSTRAINT copies_status_check CHECK (status IN ('available', 'in_transit'));
+ALTER TABLE copies DROP COLUMN IF EXISTS location;
@@ -0,0 +1,40 @@
+-- The location is a free-form shelf or section code within the branch, which lets a
+-- stocktake cover part of a branch at a time.
+ALTER TABLE copies
+ADD COLUMN IF NOT EXISTS location text NOT NULL DEFAULT '';
+-- Copies which weren't found during a stocktake can be marked as missing.
+ALTER TABLE copies DROP CONSTRAINT IF EXISTS copies_status_check;
+ALTER TABLE copies
+ADD CONSTRAINT copies_status_check CHECK (status IN ('available', 'in_transit', 'missing'));
+CREATE TABLE IF NOT EXISTS stocktakes (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    -- Stocktakes are the audit history of a branch, so they keep it from being deleted.
+    branch_id bigint NOT NULL REFERENCES branches ON DELETE RESTRICT,
+    location text NOT NULL DEFAULT '',
+    started_by bigint REFERENCES users ON DELETE SET NULL,
+    status text NOT NULL DEFAULT 'open',
+    mark_missing bool NOT NULL DEFAULT false,
+    closed_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT stocktakes_status_check CHECK (status IN ('open', 'closed'))
+);
+-- Only one session can be open for the same part of a branch at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS stocktakes_branch_id_location_open_key ON stocktakes (branch_id, location)
+WHERE status = 'open';
+CREATE TABLE IF NOT EXISTS stocktake_scans (
+    stocktake_id bigint NOT NULL REFERENCES stocktakes ON DELETE CASCADE,
+    barcode text NOT NULL,
+    scanned_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (stocktake_id, barcode)
+);
+-- The discrepancies found when a session is closed. The barcode is kept alongside the
+-- copy, as unexpected items don't match any copy.
+CREATE TABLE IF NOT EXISTS stocktake_discrepancies (
+    stocktake_id bigint NOT NULL REFERENCES stocktakes ON DELETE CASCADE,
+    barcode text NOT NULL,
+    copy_id bigint REFERENCES copies ON DELETE SET NULL,
+    kind text NOT NULL,
+    PRIMARY KEY (stocktake_id, barcode, kind),
+    CONSTRAINT stocktake_discrepancies_kind_check CHECK (kind IN ('missing', 'misplaced', 'unexpected', 'found'))
+);
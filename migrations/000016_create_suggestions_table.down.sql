@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'suggestions:manage';
+DROP TABLE IF EXISTS suggestions;
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS suggestions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    title text NOT NULL,
+    author text NOT NULL DEFAULT '',
+    isbn text NOT NULL DEFAULT '',
+    year integer NOT NULL DEFAULT 0,
+    note text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'pending',
+    librarian_note text NOT NULL DEFAULT '',
+    -- The book created from the suggestion once it has been received.
+    book_id bigint REFERENCES books ON DELETE SET NULL,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT suggestions_status_check CHECK (
+        status IN ('pending', 'approved', 'rejected', 'ordered', 'received')
+    )
+);
+CREATE INDEX IF NOT EXISTS suggestions_user_id_idx ON suggestions (user_id);
+CREATE INDEX IF NOT EXISTS suggestions_status_idx ON suggestions (status);
+-- Add the permission for reviewing and processing purchase suggestions.
+INSERT INTO permissions (code)
+VALUES ('suggestions:manage');
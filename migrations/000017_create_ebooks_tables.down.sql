@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS ebook_loans;
+DROP TABLE IF EXISTS ebooks;
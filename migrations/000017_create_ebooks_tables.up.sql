@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS ebooks (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    format text NOT NULL,
+    filename text NOT NULL,
+    content_type text NOT NULL,
+    -- The SHA-256 key of the file in the blob store.
+    blob_key text NOT NULL,
+    size bigint NOT NULL,
+    -- The number of patrons who may have the file on loan at the same time.
+    licenses integer NOT NULL,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT ebooks_format_check CHECK (format IN ('epub', 'pdf')),
+    CONSTRAINT ebooks_licenses_check CHECK (licenses > 0)
+);
+CREATE INDEX IF NOT EXISTS ebooks_book_id_idx ON ebooks (book_id);
+CREATE TABLE IF NOT EXISTS ebook_loans (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    ebook_id bigint NOT NULL REFERENCES ebooks ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    due_at timestamp(0) with time zone NOT NULL,
+    returned_at timestamp(0) with time zone
+);
+-- A loan is active until it is returned or falls due, so the license count only needs
+-- to look at loans which haven't been returned.
+CREATE INDEX IF NOT EXISTS ebook_loans_ebook_id_idx ON ebook_loans (ebook_id) WHERE returned_at IS NULL;
+CREATE INDEX IF NOT EXISTS ebook_loans_user_id_idx ON ebook_loans (user_id);
@@ -0,0 +1,8 @@
+-- Give tokens an ID, so that sessions can be revoked without exposing their hashes, and
+-- record where each authentication token was issued.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS id bigserial;
+CREATE UNIQUE INDEX IF NOT EXISTS tokens_id_key ON tokens (id);
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS tokens_user_id_idx ON tokens (user_id);
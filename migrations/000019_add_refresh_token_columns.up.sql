@@ -0,0 +1,6 @@
+-- Tokens issued from the same login share a family, so that the whole chain of
+-- refreshed tokens can be revoked at once. Used refresh tokens are kept, with used_at
+-- set, until they expire so that reuse can be detected.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family) WHERE family <> '';
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS totp_credentials (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    -- The base32-encoded shared secret. It has to be kept in a form that can be used to
+    -- compute codes, so unlike passwords it can't be hashed.
+    secret text NOT NULL,
+    -- Enrollment only takes effect once the user has proven that their authenticator
+    -- app works by submitting a code.
+    confirmed boolean NOT NULL DEFAULT false,
+    -- The time step of the last accepted code, so that a code can't be used twice.
+    last_step bigint NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    used_at timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes (user_id);
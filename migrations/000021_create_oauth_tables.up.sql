@@ -0,0 +1,45 @@
+-- Third-party apps registered to use the OAuth 2.0 authorization server. The scopes a
+-- client may request are permission codes.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id text PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    -- NULL for public clients, such as mobile and single-page apps, which can't keep a
+    -- secret.
+    secret_hash bytea,
+    redirect_uris text[] NOT NULL,
+    scopes text[] NOT NULL
+);
+CREATE INDEX IF NOT EXISTS oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+-- The scopes each user has agreed to give each client.
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    client_id text NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    scopes text[] NOT NULL,
+    PRIMARY KEY (user_id, client_id)
+);
+
+-- Authorization codes are exchanged for an access token once, shortly after being
+-- issued.
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    hash bytea PRIMARY KEY,
+    client_id text NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    redirect_uri text NOT NULL,
+    scopes text[] NOT NULL,
+    code_challenge text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+    hash bytea PRIMARY KEY,
+    client_id text NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    scopes text[] NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS oauth_tokens_user_id_client_id_idx ON oauth_tokens (user_id, client_id);
@@ -0,0 +1,41 @@
+-- Roles bundle permissions, so that staff can be given everything their job needs at
+-- once. Users get the permissions of their roles on top of any granted individually.
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+CREATE INDEX IF NOT EXISTS users_roles_role_id_idx ON users_roles (role_id);
+
+-- Add the permission for granting and revoking roles.
+INSERT INTO permissions (code)
+VALUES ('roles:manage');
+
+INSERT INTO roles (name)
+VALUES ('patron'),
+    ('librarian'),
+    ('admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'patron' AND permissions.code = 'books:read')
+OR (roles.name = 'librarian' AND permissions.code IN (
+    'books:read', 'books:write', 'genres:write', 'reviews:moderate', 'copies:write', 'suggestions:manage'
+))
+OR roles.name = 'admin';
+
+-- Every existing user is a patron.
+INSERT INTO users_roles
+SELECT users.id, roles.id
+FROM users, roles
+WHERE roles.name = 'patron';
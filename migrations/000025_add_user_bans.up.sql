@@ -0,0 +1,12 @@
+-- Banned users can't log in or use the API until the ban is lifted.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_at timestamp(0) with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ban_reason text NOT NULL DEFAULT '';
+
+-- Add the permission for managing users, and give it to admins.
+INSERT INTO permissions (code)
+VALUES ('users:admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'users:admin';
@@ -0,0 +1,6 @@
+-- The new email address of a pending email change, stored alongside the token that
+-- was sent to it. Deleting the token cancels the change.
+CREATE TABLE IF NOT EXISTS email_changes (
+    token_hash bytea PRIMARY KEY REFERENCES tokens ON DELETE CASCADE,
+    email citext NOT NULL
+);
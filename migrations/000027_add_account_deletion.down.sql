@@ -0,0 +1,7 @@
+DELETE FROM ebook_loans WHERE user_id IS NULL;
+ALTER TABLE ebook_loans DROP CONSTRAINT IF EXISTS ebook_loans_user_id_fkey;
+ALTER TABLE ebook_loans ADD CONSTRAINT ebook_loans_user_id_fkey FOREIGN KEY (user_id) REFERENCES users ON DELETE CASCADE;
+ALTER TABLE ebook_loans ALTER COLUMN user_id SET NOT NULL;
+
+DROP INDEX IF EXISTS users_delete_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS delete_at;
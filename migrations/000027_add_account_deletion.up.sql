@@ -0,0 +1,10 @@
+-- Users who delete their account are only deleted once delete_at has passed, so that
+-- they can change their mind.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS delete_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS users_delete_at_idx ON users (delete_at) WHERE delete_at IS NOT NULL;
+
+-- Keep the loans of deleted users for the library's records, without saying who
+-- borrowed the book.
+ALTER TABLE ebook_loans ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE ebook_loans DROP CONSTRAINT IF EXISTS ebook_loans_user_id_fkey;
+ALTER TABLE ebook_loans ADD CONSTRAINT ebook_loans_user_id_fkey FOREIGN KEY (user_id) REFERENCES users ON DELETE SET NULL;
@@ -0,0 +1,3 @@
+-- Users deactivated by an admin can't activate their account again until an admin
+-- forces re-activation.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated_at timestamp(0) with time zone;